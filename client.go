@@ -0,0 +1,508 @@
+package goipmi
+
+import (
+	"context"
+	"encoding"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"sync"
+)
+
+// Client implements the high level IPMI operations (SDR, SEL, device
+// information) on top of any Transport.
+type Client struct {
+	Transport
+	// SdrCache, when set, keeps the SDR repository between walks
+	SdrCache *SdrCache
+
+	mu  sync.Mutex
+	oem *uint32
+	// factors caches the reading factors of non-linear sensors
+	factors map[sensorFactorsKey]SensorFactors
+	// deviceSdrs is set once Get Device ID told which SDRs to walk
+	deviceSdrs *bool
+	// sdrReadLen is the Get SDR read length the BMC accepts, 0 if unknown
+	sdrReadLen int
+}
+
+func NewClient(t Transport) *Client {
+	return &Client{Transport: t}
+}
+
+// SendMessage is SendMessageContext without a deadline, the transport's
+// per-request timeout still applies.
+func (c *Client) SendMessage(req Message, resp encoding.BinaryUnmarshaler) error {
+	return c.SendMessageContext(context.Background(), req, resp)
+}
+
+func (c *Client) getSdrChunk(ctx context.Context, device *SensorOwner, reservationId, recordId uint16, offset, length uint8) (uint16, []byte, error) {
+	var req Message = &GetSdrReq{
+		ReservationId: reservationId,
+		RecordId:      recordId,
+		Offset:        offset,
+		BytesToRead:   length,
+	}
+	if device != nil {
+		req = &GetDeviceSdrReq{
+			SensorOwner:   *device,
+			ReservationId: reservationId,
+			RecordId:      recordId,
+			Offset:        offset,
+			BytesToRead:   length,
+		}
+	}
+	sr := &GetSdrRsp{}
+	if err := c.SendMessageContext(ctx, req, sr); err != nil {
+		return 0, nil, err
+	}
+	return sr.NextRecordId, sr.RecordData, nil
+}
+
+const (
+	sdrHeaderLength = 5
+	// sdrMinReadLength is the smallest Get SDR read tried before giving up
+	sdrMinReadLength = 4
+	// sdrReserveRetries bounds re-reservations for a single record
+	sdrReserveRetries = 3
+)
+
+// sdrReadLength returns the largest Get SDR read known to work, 0 if no
+// read was refused yet
+func (c *Client) sdrReadLength() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sdrReadLen
+}
+
+// shrinkSdrReadLength halves the read length after a read of n bytes was
+// refused, it returns false once the minimum is reached
+func (c *Client) shrinkSdrReadLength(n int) bool {
+	if n <= sdrMinReadLength {
+		return false
+	}
+	n /= 2
+	if n < sdrMinReadLength {
+		n = sdrMinReadLength
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sdrReadLen == 0 || n < c.sdrReadLen {
+		c.sdrReadLen = n
+	}
+	return true
+}
+
+func sdrReadRefused(err error) bool {
+	switch errors.Cause(err) {
+	case ErrRequestData, ErrDataTruncated:
+		return true
+	}
+	return false
+}
+
+// getSdrDataHelper reads the record header and then the body in chunks,
+// shrinking the chunk size when the BMC refuses a read. device, when set,
+// selects Get Device SDR to that controller instead of Get SDR.
+func (c *Client) getSdrDataHelper(ctx context.Context, device *SensorOwner, recordId, reservationId uint16) (uint16, []byte, error) {
+	nextId, header, err := c.getSdrChunk(ctx, device, reservationId, recordId, 0, sdrHeaderLength)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(header) < sdrHeaderLength {
+		return 0, nil, errors.Errorf("SDR record 0x%04x: short header", recordId)
+	}
+	recordId = binary.LittleEndian.Uint16(header)
+	length := sdrHeaderLength + int(header[4])
+	data := make([]byte, sdrHeaderLength, length)
+	copy(data, header)
+	for len(data) < length {
+		if len(data) > 0xff {
+			// the offset of Get SDR is a single byte
+			return 0, nil, errors.Errorf("SDR record 0x%04x: %d bytes cannot be read past offset 255", recordId, length)
+		}
+		n := length - len(data)
+		if max := c.sdrReadLength(); max != 0 && n > max {
+			n = max
+		}
+		_, chunk, err := c.getSdrChunk(ctx, device, reservationId, recordId, uint8(len(data)), uint8(n))
+		if err != nil {
+			if sdrReadRefused(err) && c.shrinkSdrReadLength(n) {
+				continue
+			}
+			return 0, nil, err
+		}
+		if len(chunk) == 0 || len(data)+len(chunk) > length {
+			return 0, nil, errors.Errorf("SDR record 0x%04x: got %d bytes at offset %d, record length is %d",
+				recordId, len(chunk), len(data), length)
+		}
+		data = append(data, chunk...)
+	}
+	return nextId, data, nil
+}
+
+func (c *Client) GetRepositorySdr(recordId, reservationId uint16) (SdrCommon, uint16, error) {
+	return c.GetRepositorySdrContext(context.Background(), recordId, reservationId)
+}
+
+func (c *Client) GetRepositorySdrContext(ctx context.Context, recordId, reservationId uint16) (SdrCommon, uint16, error) {
+	nextId, recordData, err := c.getSdrDataHelper(ctx, nil, recordId, reservationId)
+	if err != nil {
+		return nil, nextId, err
+	}
+	sdr, err := SdrCommonFromData(recordData, nextId)
+	if err != nil {
+		return nil, nextId, err
+	}
+	return sdr, nextId, nil
+}
+
+func (c *Client) GetDeviceId() (*DevidRsp, error) {
+	resp := &DevidRsp{}
+	if err := c.SendMessage(&GetOem{}, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) GetOem() (uint32, error) {
+	return c.GetOemContext(context.Background())
+}
+
+// GetOemContext returns the manufacturer id of the BMC, it is read once
+// and cached
+func (c *Client) GetOemContext(ctx context.Context) (uint32, error) {
+	c.mu.Lock()
+	oem := c.oem
+	c.mu.Unlock()
+	if oem != nil {
+		return *oem, nil
+	}
+	resp := &DevidRsp{}
+	if err := c.SendMessageContext(ctx, &GetOem{}, resp); err != nil {
+		return 0, err
+	}
+	id := uint32(resp.ManufacturerId[2]&0x0F)<<16 | uint32(resp.ManufacturerId[1])<<8 | uint32(resp.ManufacturerId[0])
+	c.mu.Lock()
+	c.oem = &id
+	c.mu.Unlock()
+	return id, nil
+}
+func (c *Client) SelEntries(fun func([]byte) bool) error {
+	return c.SelEntriesContext(context.Background(), fun)
+}
+
+// SelEntriesContext walks the SEL, ctx bounds the whole walk
+func (c *Client) SelEntriesContext(ctx context.Context, fun func([]byte) bool) error {
+	resp := &GetReserveSelRsp{}
+	err := c.SendMessageContext(ctx, &GetSelInfoReq{}, resp)
+	if err != nil {
+		return err
+	}
+	if resp.Date[0] == 0 && resp.Date[1] == 0 {
+		return errors.New("SEL has no entries")
+	}
+	err = c.SendMessageContext(ctx, &ReserveSelReq{}, resp)
+	if err != nil {
+		return err
+	}
+	var nextId uint16
+	var currId uint16
+	var eRsp GetReserveSelRsp
+	nilNextId := 2
+	for nextId != uint16(0xffff) {
+		currId = nextId
+		if err = c.SendMessageContext(ctx, &GetSelEntryReq{
+			Id:          currId,
+			Offset:      0,
+			BytesToRead: 0xff,
+		}, &eRsp); err != nil {
+			return err
+		}
+		if len(eRsp.Date) < 2 {
+			return DataTooShort
+		}
+		nextId = uint16(eRsp.Date[0]) | uint16(eRsp.Date[1])<<8
+		//
+		if nextId == 0 {
+			nilNextId -= 1
+			if nilNextId <= 0 {
+				break
+			}
+			continue
+		}
+		if !fun(eRsp.Date[2:]) {
+			break
+		}
+		//fmt.Printf("SEL Record ID %d\n", eRsp.RecordId)
+		//
+		//if eRsp.RecordType == 0xf0 {
+		//	fmt.Printf("Record Type           : Linux kernel panic %d\n", eRsp.RecordType)
+		//	continue
+		//}
+		//fmt.Printf(" Record Type           : %02x", eRsp.RecordType)
+		//if eRsp.RecordType >= 0xc0 {
+		//	if eRsp.RecordType < 0xe0 {
+		//		fmt.Print("(OEM timestamped)")
+		//	} else {
+		//		fmt.Print("(OEM non-timestamped)")
+		//	}
+		//}
+		//fmt.Println("")
+		//if eRsp.RecordType < 0xe0 {
+		//	fmt.Print(" Timestamp             : ")
+		//	if eRsp.RecordType < 0xc0 {
+		//		fmt.Println(time.Unix(int64(eRsp.StandardType.Timestamp), 0))
+		//	} else {
+		//		fmt.Println(time.Unix(int64(eRsp.OemTsType.Timestamp), 0))
+		//	}
+		//}
+		//if eRsp.RecordType >= 0xc0 {
+		//	if eRsp.RecordType < 0xdf {
+		//		fmt.Printf(" Manufactacturer ID    : %02x%02x%02x\n", eRsp.OemTsType.ManfId[0],
+		//			eRsp.OemTsType.ManfId[1], eRsp.OemTsType.ManfId[2])
+		//		fmt.Printf(" OEM Defined           : %v", eRsp.OemTsType.OemDefined)
+		//	} else {
+		//		fmt.Printf(" OEM Defined           : %v", eRsp.OemNotsType.OemDefined)
+		//	}
+		//	continue
+		//}
+		//fmt.Printf(" Generator ID          : %04x\n", eRsp.StandardType.GenId)
+		//fmt.Printf(" EvM Revision          : %04x\n", eRsp.StandardType.EventType)
+		//fmt.Printf(" Sensor Type           : %s\n", getSensorType(eRsp.StandardType.SensorType))
+		//fmt.Printf(" Sensor Numbe          : %d\n", eRsp.StandardType.SensorNum)
+		//fmt.Printf(" Event Type            : %s\n", getEventType(eRsp.StandardType.EventType))
+		//val, ok := EventDirVals[eRsp.StandardType.EventDir]
+		//if ok {
+		//	fmt.Printf(" Event Direction       : %s\n", val)
+		//} else {
+		//	fmt.Printf(" Event Direction       : Unknown (0x%02X)\n", eRsp.StandardType.EventDir)
+		//}
+		//fmt.Printf(" Event Data (RAW)      : %02x%02x%02x\n", eRsp.StandardType.EventData[0], eRsp.StandardType.EventData[1], eRsp.StandardType.EventData[2])
+		//description, err := l.GetEventDesc(eRsp)
+		//if err != nil {
+		//	return err
+		//}
+		//fmt.Printf(" Description       : %s\n", description)
+	}
+	return nil
+}
+
+// walkSdrRepository calls fun for every record of the SDR repository,
+// records of unsupported types are skipped
+func (c *Client) walkSdrRepository(ctx context.Context, fun func(SdrCommon) error) error {
+	records, err := c.sdrRepository(ctx)
+	if err != nil {
+		return err
+	}
+	for _, sdr := range records {
+		if err := fun(sdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sdrRepository returns the decoded SDRs of the controller, from
+// c.SdrCache when the repository did not change since it was cached.
+// Sensor devices without an SDR repository are read through Device SDRs.
+func (c *Client) sdrRepository(ctx context.Context) ([]SdrCommon, error) {
+	device, err := c.deviceSdrOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cache := c.SdrCache
+	var info *GetSdrRepositoryInfoRsp
+	if device == nil && cache != nil {
+		// without the repository info the cache cannot be validated, the
+		// repository is then read uncached
+		if info, err = c.GetSdrRepositoryInfo(ctx); err == nil {
+			if records, ok := cache.lookup(info); ok {
+				return records, nil
+			}
+		}
+	}
+	raw, err := c.fetchSdrRecords(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	// the factors of non-linear sensors are read again with the records
+	c.mu.Lock()
+	c.factors = nil
+	c.mu.Unlock()
+	records, err := decodeSdrRecords(raw)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return records, nil
+	}
+	return records, cache.store(info, raw, records)
+}
+
+// deviceSdrOwner returns the BMC itself when it only has Device SDRs and
+// nil when it has an SDR repository, from the SDR repository and sensor
+// device bits of Get Device ID
+func (c *Client) deviceSdrOwner(ctx context.Context) (*SensorOwner, error) {
+	c.mu.Lock()
+	cached := c.deviceSdrs
+	c.mu.Unlock()
+	if cached == nil {
+		resp := &DevidRsp{}
+		if err := c.SendMessageContext(ctx, &GetOem{}, resp); err != nil {
+			return nil, err
+		}
+		device := !resp.SdrRepositoryDevice() && resp.SensorDevice()
+		c.mu.Lock()
+		c.deviceSdrs = &device
+		c.mu.Unlock()
+		cached = &device
+	}
+	if !*cached {
+		return nil, nil
+	}
+	return &SensorOwner{}, nil
+}
+
+// fetchSdrRecords reads every raw record of the SDR repository, or of the
+// Device SDRs of the controller device when it is set
+func (c *Client) fetchSdrRecords(ctx context.Context, device *SensorOwner) ([]sdrRecord, error) {
+	reservationId, err := c.reserveSdrs(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	var records []sdrRecord
+	recordId := uint16(0)
+	retries := 0
+	for recordId != uint16(0xffff) {
+		nextId, data, err := c.getSdrDataHelper(ctx, device, recordId, reservationId)
+		if errors.Cause(err) == ErrInvalidResv && retries < sdrReserveRetries {
+			// the repository changed or another client reserved it
+			retries++
+			if reservationId, err = c.reserveSdrs(ctx, device); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if errors.Cause(err) == ErrNoObj && recordId == 0 {
+			// an empty repository has no first record
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		retries = 0
+		records = append(records, sdrRecord{NextId: nextId, Data: data})
+		recordId = nextId
+	}
+	return records, nil
+}
+
+func (c *Client) reserveSdrs(ctx context.Context, device *SensorOwner) (uint16, error) {
+	if device == nil {
+		return c.getReserveSDRRepoForReserveId(ctx)
+	}
+	res := &ReserveSdrRepositoryRsp{}
+	err := c.SendMessageContext(ctx, &ReserveDeviceSdrRepositoryReq{SensorOwner: *device}, res)
+	if errors.Cause(err) == ErrInvalidCommand {
+		// the reservation is optional for sensor devices
+		return 0, nil
+	}
+	return res.ReservationId, err
+}
+
+func (c *Client) GetSdrRepositoryInfo(ctx context.Context) (*GetSdrRepositoryInfoRsp, error) {
+	info := &GetSdrRepositoryInfoRsp{}
+	if err := c.SendMessageContext(ctx, &GetSdrRepositoryInfoReq{}, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (c *Client) GetDeviceSdrInfo(ctx context.Context, device SensorOwner, sdrCount bool) (*GetDeviceSdrInfoRsp, error) {
+	info := &GetDeviceSdrInfoRsp{}
+	if err := c.SendMessageContext(ctx, &GetDeviceSdrInfoReq{SensorOwner: device, SdrCount: sdrCount}, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// DeviceSdrRecords returns every Device SDR of the sensor device that
+// SdrCommonFromData can decode, whatever Get Device ID reports. The zero
+// SensorOwner is the BMC, SdrMcDeviceLocatorRecord.Owner addresses a
+// satellite controller over IPMB.
+func (c *Client) DeviceSdrRecords(ctx context.Context, device SensorOwner) ([]SdrCommon, error) {
+	raw, err := c.fetchSdrRecords(ctx, &device)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSdrRecords(raw)
+}
+
+// SdrRepositoryRecords returns every record of the SDR repository, or the
+// Device SDRs of a sensor device, that SdrCommonFromData can decode
+func (c *Client) SdrRepositoryRecords(ctx context.Context) ([]SdrCommon, error) {
+	var records []SdrCommon
+	err := c.walkSdrRepository(ctx, func(sdr SdrCommon) error {
+		records = append(records, sdr)
+		return nil
+	})
+	return records, err
+}
+
+func (c *Client) SdrRepositoryEntries(itemFun func(string, *float64, uint8, string, uint8, uint8, string, error)) error {
+	return c.SdrRepositoryEntriesContext(context.Background(), itemFun)
+}
+
+// SdrRepositoryEntriesContext walks the SDR repository and reads every
+// full sensor, ctx bounds the whole walk. See SensorEntries.
+func (c *Client) SdrRepositoryEntriesContext(ctx context.Context, itemFun func(string, *float64, uint8, string, uint8, uint8, string, error)) error {
+	return c.SensorEntries(ctx, func(r SensorReading) bool {
+		if _, ok := r.Record.(*SdrFullSensorRecord); !ok {
+			return true
+		}
+		if r.Err != nil || r.Value == nil {
+			itemFun(r.Name, nil, 0, "", 0, 0, "", r.Err)
+			return true
+		}
+		itemFun(r.Name, r.Value, r.UnitCode, r.Unit, r.SensorTypeCode, r.EntityInstance, r.SensorType, nil)
+		return true
+	})
+}
+
+func (c *Client) SdrRepositoryStates(itemFun func(name string, sensorType string, states []string, err error)) error {
+	return c.SdrRepositoryStatesContext(context.Background(), itemFun)
+}
+
+// SdrRepositoryStatesContext walks the SDR repository and reads every
+// discrete sensor, full and compact, passing the names of its asserted
+// states. See SensorEntries.
+func (c *Client) SdrRepositoryStatesContext(ctx context.Context, itemFun func(name string, sensorType string, states []string, err error)) error {
+	return c.SensorEntries(ctx, func(r SensorReading) bool {
+		if r.discrete() {
+			itemFun(r.Name, r.SensorType, r.States, r.Err)
+		}
+		return true
+	})
+}
+
+func (c *Client) GetReserveSDRRepoForReserveId() (uint16, error) {
+	return c.getReserveSDRRepoForReserveId(context.Background())
+}
+
+func (c *Client) getReserveSDRRepoForReserveId(ctx context.Context) (uint16, error) {
+	res := &ReserveSdrRepositoryRsp{}
+	err := c.SendMessageContext(ctx, &ReserveSdrRepositoryReq{}, res)
+	return res.ReservationId, err
+}
+
+func (c *Client) GetChassisStatus() (*ChassisStatusRsp, error) {
+	resp := &ChassisStatusRsp{}
+	if err := c.SendMessage(&ChassisStatusReq{}, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) ChassisControl(control ChassisControl) error {
+	return c.SendMessage(&ChassisControlReq{Control: control}, &EmptyRsp{})
+}
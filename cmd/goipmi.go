@@ -1,25 +1,68 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/neo-hu/goipmi"
 	"github.com/olekukonko/tablewriter"
 	"os"
+	"strings"
 )
 
 func main() {
 	var sdr bool
 	var sel bool
+	var sim bool
+	var host, username, password string
+	var intf = "lanplus"
+	var cipherSuite = 3
+	var devNum int
+	var dump string
 	flag.BoolVar(&sdr, "sdr", sdr, "Print Sensor Data Repository entries and readings")
 	flag.BoolVar(&sel, "sel", sel, "Print System Event Log")
+	flag.StringVar(&host, "H", host, "Remote BMC address (host[:port]), uses the local driver when empty")
+	flag.StringVar(&username, "U", username, "Remote session username")
+	flag.StringVar(&password, "P", password, "Remote session password")
+	flag.StringVar(&intf, "I", intf, "Remote interface: lan (IPMI 1.5) or lanplus (IPMI 2.0 RMCP+)")
+	flag.IntVar(&cipherSuite, "C", cipherSuite, "RMCP+ cipher suite (lanplus)")
+	flag.IntVar(&devNum, "d", devNum, "Local interface number (/dev/ipmiN)")
+	flag.BoolVar(&sim, "sim", sim, "Use the built-in BMC simulator")
+	flag.StringVar(&dump, "dump", dump, "Write the raw SDRs to a file (ipmitool sdr dump format)")
 	flag.Parse()
-	t := goipmi.NewLocalIPMI()
+	var t *goipmi.Client
+	if sim {
+		t = goipmi.NewSampleSimulator().Client
+	} else if host != "" && intf == "lan" {
+		t = goipmi.NewLanIPMI(host, username, password).Client
+	} else if host != "" {
+		lan := goipmi.NewLanPlusIPMI(host, username, password)
+		lan.CipherSuite = uint8(cipherSuite)
+		t = lan.Client
+	} else {
+		local, err := newLocal(devNum)
+		if err != nil {
+			panic(err)
+		}
+		t = local
+	}
 	if err := t.Open(); err != nil {
 		panic(err)
 	}
 	defer t.Close()
 
+	if dump != "" {
+		f, err := os.Create(dump)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		if err := t.DumpSdr(f); err != nil {
+			panic(err)
+		}
+		return
+	}
+
 	table := tablewriter.NewWriter(os.Stdout)
 	table.SetBorder(true)
 	table.SetAutoWrapText(true)
@@ -27,16 +70,22 @@ func main() {
 	table.SetCenterSeparator("|")
 	table.SetAlignment(tablewriter.ALIGN_LEFT)
 	if sdr {
-		table.SetHeader([]string{"SEL", "Value"})
-		if err := t.SdrRepositoryEntries(func(name string, val *float64, unitCode uint8, unit string,
-			sensorTypeCode, entityInstance uint8, sensorType string, err error) {
-			table.Append([]string{
-				name,
-				fmt.Sprintf("%.2f %s", *val, unit),
-			})
-		}); err != nil {
+		table.SetHeader([]string{"Sensor", "Value", "Status"})
+		readings, err := t.Sensors(context.Background())
+		if err != nil {
 			panic(err)
 		}
+		for _, r := range readings {
+			value := "na"
+			if r.Err != nil {
+				value = r.Err.Error()
+			} else if r.Value != nil {
+				value = fmt.Sprintf("%.2f %s", *r.Value, r.Unit)
+			} else if len(r.States) > 0 {
+				value = strings.Join(r.States, ", ")
+			}
+			table.Append([]string{r.Name, value, r.Status.String()})
+		}
 	} else if sel {
 		oem, err := t.GetOem()
 		if err != nil {
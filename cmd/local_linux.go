@@ -0,0 +1,9 @@
+// +build linux
+
+package main
+
+import "github.com/neo-hu/goipmi"
+
+func newLocal(devNum int) (*goipmi.Client, error) {
+	return goipmi.NewLocalIPMI(goipmi.WithInterface(devNum)).Client, nil
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"github.com/neo-hu/goipmi"
+)
+
+func newLocal(devNum int) (*goipmi.Client, error) {
+	return nil, errors.New("the local interface needs the Linux ipmi driver, use -H or -sim")
+}
@@ -1,5 +1,3 @@
-// +build linux
-
 package goipmi
 
 import "fmt"
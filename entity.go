@@ -0,0 +1,252 @@
+package goipmi
+
+import (
+	"context"
+	"fmt"
+)
+
+// Entity ids (table 43-13) used to navigate an EntityTree
+const (
+	EntityProcessor       = uint8(0x03)
+	EntitySystemBoard     = uint8(0x07)
+	EntityMemoryModule    = uint8(0x08)
+	EntityProcessorModule = uint8(0x09)
+	EntityPowerSupply     = uint8(0x0a)
+	EntitySystemChassis   = uint8(0x17)
+	EntityFan             = uint8(0x1d)
+	EntityMemoryDevice    = uint8(0x20)
+)
+
+var entityIdNames = []string{
+	"Unspecified", "Other", "Unknown", "Processor",
+	"Disk or Disk Bay", "Peripheral Bay", "System Management Module", "System Board",
+	"Memory Module", "Processor Module", "Power Supply", "Add-in Card",
+	"Front Panel Board", "Back Panel Board", "Power System Board", "Drive Backplane",
+	"System Internal Expansion Board", "Other System Board", "Processor Board", "Power Unit",
+	"Power Module", "Power Management", "Chassis Back Panel Board", "System Chassis",
+	"Sub-Chassis", "Other Chassis Board", "Disk Drive Bay", "Peripheral Bay",
+	"Device Bay", "Fan Device", "Cooling Unit", "Cable/Interconnect",
+	"Memory Device", "System Management Software", "System Firmware", "Operating System",
+	"System Bus", "Group", "Remote Management Device", "External Environment",
+	"Battery", "Processing Blade", "Connectivity Switch", "Processor/Memory Module",
+	"I/O Module", "Processor/IO Module", "Management Controller Firmware", "IPMI Channel",
+	"PCI Bus", "PCI Express Bus", "SCSI Bus (parallel)", "SATA/SAS Bus",
+	"Processor/Front-Side Bus", "Real Time Clock", "reserved", "Air Inlet",
+	"reserved", "reserved", "reserved", "reserved",
+	"reserved", "reserved", "reserved", "reserved",
+	"Air Inlet", "Processor", "Baseboard",
+}
+
+// EntityName returns the name of an entity id
+func EntityName(id uint8) string {
+	switch {
+	case int(id) < len(entityIdNames):
+		return entityIdNames[id]
+	case id >= 0x90 && id <= 0xaf:
+		return "Chassis-specific"
+	case id >= 0xb0 && id <= 0xcf:
+		return "Board-set specific"
+	case id >= 0xd0:
+		return "OEM"
+	}
+	return "reserved"
+}
+
+// DeviceRelative reports whether the instance is relative to the
+// controller owning the entity (instances 60h-7Fh)
+func (e EntityRef) DeviceRelative() bool {
+	return e.Instance&0x7f >= 0x60
+}
+
+// InstanceNumber returns the instance without the device-relative offset
+func (e EntityRef) InstanceNumber() uint8 {
+	if e.DeviceRelative() {
+		return e.Instance&0x7f - 0x60
+	}
+	return e.Instance & 0x7f
+}
+
+// String returns the entity as "Power Supply 2"
+func (e EntityRef) String() string {
+	s := fmt.Sprintf("%s %d", EntityName(e.Id), e.InstanceNumber())
+	if e.DeviceRelative() {
+		s += fmt.Sprintf(" (controller %02Xh)", e.Owner)
+	}
+	return s
+}
+
+// normalize drops the owner of a system-relative instance, a
+// device-relative instance without owner is taken as relative to the BMC
+func (e EntityRef) normalize() EntityRef {
+	if !e.DeviceRelative() {
+		e.Owner = 0
+	} else if e.Owner == 0 {
+		e.Owner = bmcSlaveAddr
+	}
+	return e
+}
+
+func (s *SdrFullSensorRecord) Entity() EntityRef {
+	return EntityRef{Id: s.entityId, Instance: s.entityInstance, Owner: s.ownerId}.normalize()
+}
+
+func (s *SdrCompactSensorRecord) Entity() EntityRef {
+	return EntityRef{Id: s.entityId, Instance: s.entityInstance, Owner: s.ownerId}.normalize()
+}
+
+func (s *SdrEventOnlySensorRecord) Entity() EntityRef {
+	return EntityRef{Id: s.EntityId, Instance: s.EntityInstance, Owner: s.OwnerId}.normalize()
+}
+
+func (s *SdrFruDeviceLocatorRecord) Entity() EntityRef {
+	return EntityRef{Id: s.EntityId, Instance: s.EntityInstance, Owner: s.AccessAddress}.normalize()
+}
+
+func (s *SdrMcDeviceLocatorRecord) Entity() EntityRef {
+	return EntityRef{Id: s.EntityId, Instance: s.EntityInstance, Owner: s.SlaveAddress}.normalize()
+}
+
+func (r *SensorReading) Entity() EntityRef {
+	return EntityRef{Id: r.EntityId, Instance: r.EntityInstance, Owner: r.OwnerId}.normalize()
+}
+
+// EntityNode is an entity of an EntityTree with the records describing it
+type EntityNode struct {
+	Entity   EntityRef
+	Parent   *EntityNode
+	Children []*EntityNode
+	// Records are the sensor and locator records of the entity, shared
+	// sensor records are expanded
+	Records []SdrCommon
+}
+
+// EntityTree relates the entities of a platform as its entity
+// association records describe them: a processor contains its DIMMs, a
+// power supply its sensors.
+type EntityTree struct {
+	nodes map[EntityRef]*EntityNode
+	order []*EntityNode
+}
+
+// NewEntityTree builds the tree of the entities found in records
+func NewEntityTree(records []SdrCommon) *EntityTree {
+	t := &EntityTree{nodes: map[EntityRef]*EntityNode{}}
+	for _, sdr := range records {
+		switch r := sdr.(type) {
+		case *SdrEntityAssociationRecord:
+			container := t.node(r.Container)
+			for _, e := range r.ContainedEntities() {
+				t.link(container, t.node(e))
+			}
+		case *SdrCompactSensorRecord:
+			for _, shared := range r.Shared() {
+				t.addRecord(shared.Entity(), shared)
+			}
+		case *SdrEventOnlySensorRecord:
+			for _, shared := range r.Shared() {
+				t.addRecord(shared.Entity(), shared)
+			}
+		case interface{ Entity() EntityRef }:
+			t.addRecord(r.Entity(), sdr)
+		}
+	}
+	return t
+}
+
+// EntityTree reads the SDRs and builds their EntityTree
+func (c *Client) EntityTree(ctx context.Context) (*EntityTree, error) {
+	records, err := c.sdrRepository(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewEntityTree(records), nil
+}
+
+func (t *EntityTree) node(e EntityRef) *EntityNode {
+	e = e.normalize()
+	n, ok := t.nodes[e]
+	if !ok {
+		n = &EntityNode{Entity: e}
+		t.nodes[e] = n
+		t.order = append(t.order, n)
+	}
+	return n
+}
+
+// link makes child a child of parent unless it already has a container or
+// the association would form a loop
+func (t *EntityTree) link(parent, child *EntityNode) {
+	if child.Parent != nil {
+		return
+	}
+	for p := parent; p != nil; p = p.Parent {
+		if p == child {
+			return
+		}
+	}
+	child.Parent = parent
+	parent.Children = append(parent.Children, child)
+}
+
+func (t *EntityTree) addRecord(e EntityRef, sdr SdrCommon) {
+	n := t.node(e)
+	n.Records = append(n.Records, sdr)
+}
+
+// Node returns the node of e, nil if no record mentions e
+func (t *EntityTree) Node(e EntityRef) *EntityNode {
+	return t.nodes[e.normalize()]
+}
+
+// Roots returns the entities not contained in another one
+func (t *EntityTree) Roots() []*EntityNode {
+	var roots []*EntityNode
+	for _, n := range t.order {
+		if n.Parent == nil {
+			roots = append(roots, n)
+		}
+	}
+	return roots
+}
+
+// Contains reports whether e is container or one of the entities below it
+func (t *EntityTree) Contains(container, e EntityRef) bool {
+	c := t.Node(container)
+	for n := t.Node(e); n != nil && c != nil; n = n.Parent {
+		if n == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Descendants returns the entities below e, depth first
+func (t *EntityTree) Descendants(e EntityRef) []EntityRef {
+	var entities []EntityRef
+	t.walk(t.Node(e), func(n *EntityNode) {
+		entities = append(entities, n.Entity)
+	})
+	if len(entities) > 0 {
+		entities = entities[1:]
+	}
+	return entities
+}
+
+// Records returns the records of e and of the entities below it
+func (t *EntityTree) Records(e EntityRef) []SdrCommon {
+	var records []SdrCommon
+	t.walk(t.Node(e), func(n *EntityNode) {
+		records = append(records, n.Records...)
+	})
+	return records
+}
+
+func (t *EntityTree) walk(n *EntityNode, fun func(*EntityNode)) {
+	if n == nil {
+		return
+	}
+	fun(n)
+	for _, child := range n.Children {
+		t.walk(child, fun)
+	}
+}
@@ -0,0 +1,11 @@
+// +build linux
+// +build !ppc64,!ppc64le,!mips,!mipsle,!mips64,!mips64le
+
+package goipmi
+
+// ioctl direction bits of <asm-generic/ioctl.h>
+const (
+	iocWrite    = 1
+	iocRead     = 2
+	iocDirShift = 30
+)
@@ -0,0 +1,27 @@
+// +build linux
+
+package goipmi
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestIoctlNumbers(t *testing.T) {
+	// values of <linux/ipmi.h> as built by the kernel headers
+	want := map[string][3]uintptr{
+		"amd64":   {0xc030690b, 0x8028690d, 0x80046910},
+		"arm64":   {0xc030690b, 0x8028690d, 0x80046910},
+		"386":     {0xc018690b, 0x8014690d, 0x80046910},
+		"ppc64le": {0xc030690b, 0x4028690d, 0x40046910},
+		"mips":    {0xc018690b, 0x4014690d, 0x40046910},
+	}
+	w, ok := want[runtime.GOARCH]
+	if !ok {
+		t.Skipf("no reference values for %s", runtime.GOARCH)
+	}
+	got := [3]uintptr{ipmictlReceiveMsgTrunc, ipmictlSendCommand, ipmictlSetGetsEventsCmd}
+	if got != w {
+		t.Errorf("got %#x, want %#x", got, w)
+	}
+}
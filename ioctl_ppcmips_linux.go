@@ -0,0 +1,12 @@
+// +build linux
+// +build ppc64 ppc64le mips mipsle mips64 mips64le
+
+package goipmi
+
+// ioctl direction bits of <asm/ioctl.h> on powerpc and mips, the
+// direction field is 3 bits wide and starts at bit 29
+const (
+	iocWrite    = 4
+	iocRead     = 2
+	iocDirShift = 29
+)
@@ -0,0 +1,83 @@
+// +build linux
+
+package goipmi
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Definitions from <linux/ipmi.h>
+
+const (
+	ipmiIocMagic = 'i'
+
+	ipmiIpmbAddrType            = 0x01
+	ipmiSystemInterfaceAddrType = 0x0c
+	ipmiBmcChannel              = 0x0f
+	ipmiMaxAddrSize             = 32
+
+	ipmiResponseRecvType   = 1
+	ipmiAsyncEventRecvType = 2
+
+	ipmiBufSize = 1024
+)
+
+type ipmiSystemInterfaceAddr struct {
+	AddrType int32
+	Channel  int16
+	Lun      uint8
+	_        uint8
+}
+
+type ipmiIpmbAddr struct {
+	AddrType  int32
+	Channel   int16
+	SlaveAddr uint8
+	Lun       uint8
+}
+
+type ipmiAddr struct {
+	AddrType int32
+	Channel  int16
+	Data     [ipmiMaxAddrSize]byte
+}
+
+type ipmiMsg struct {
+	Netfn   uint8
+	Cmd     uint8
+	DataLen uint16
+	Data    unsafe.Pointer
+}
+
+type ipmiReq struct {
+	Addr    unsafe.Pointer
+	AddrLen uint32
+	Msgid   int // C long
+	Msg     ipmiMsg
+}
+
+type ipmiRecv struct {
+	RecvType int32
+	Addr     unsafe.Pointer
+	AddrLen  uint32
+	Msgid    int // C long
+	Msg      ipmiMsg
+}
+
+// ioctl request numbers, iocRead, iocWrite and iocDirShift are per
+// architecture
+func ioc(dir, nr, size uintptr) uintptr {
+	return dir<<iocDirShift | size<<16 | ipmiIocMagic<<8 | nr
+}
+
+var (
+	ipmictlReceiveMsgTrunc  = ioc(iocRead|iocWrite, 11, unsafe.Sizeof(ipmiRecv{}))
+	ipmictlSendCommand      = ioc(iocRead, 13, unsafe.Sizeof(ipmiReq{}))
+	ipmictlSetGetsEventsCmd = ioc(iocRead, 16, unsafe.Sizeof(int32(0)))
+)
+
+func ioctl(fd, req uintptr, arg unsafe.Pointer) syscall.Errno {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	return errno
+}
@@ -0,0 +1,445 @@
+package goipmi
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	rmcpVersion1  = uint8(0x06)
+	rmcpNoAck     = uint8(0xff)
+	rmcpClassIPMI = uint8(0x07)
+
+	bmcSlaveAddr = uint8(0x20)
+	remoteSwId   = uint8(0x81)
+
+	defaultLanPort    = "623"
+	defaultLanTimeout = 2 * time.Second
+	defaultLanRetries = 2
+)
+
+// lanAuthTypes is the order authentication types are tried in when
+// LanIPMI.AuthTypes is empty
+var lanAuthTypes = []AuthType{AuthTypeMD5, AuthTypePassword, AuthTypeNone}
+
+// LanIPMI is the Transport for IPMI 1.5 sessions over RMCP (UDP port 623).
+type LanIPMI struct {
+	*Client
+	// Addr is host or host:port of the BMC, the port defaults to 623
+	Addr     string
+	Username string
+	Password string
+	// AuthTypes lists the acceptable authentication types in order of preference
+	AuthTypes []AuthType
+	PrivLevel PrivilegeLevel
+	Timeout   time.Duration
+	Retries   int
+
+	mu         sync.Mutex
+	conn       net.Conn
+	authType   AuthType
+	sessionId  uint32
+	sessionSeq uint32
+	rqSeq      uint8
+	close      int32
+}
+
+func NewLanIPMI(addr, username, password string) *LanIPMI {
+	l := &LanIPMI{
+		Addr:      addr,
+		Username:  username,
+		Password:  password,
+		PrivLevel: PrivilegeLevelAdministrator,
+		Timeout:   defaultLanTimeout,
+		Retries:   defaultLanRetries,
+	}
+	l.Client = NewClient(l)
+	return l
+}
+
+func (l *LanIPMI) Open() error {
+	addr := l.Addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultLanPort)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to connect to %s", addr)
+	}
+	l.mu.Lock()
+	l.conn = conn
+	l.mu.Unlock()
+	atomic.StoreInt32(&l.close, 0)
+	if err := l.activateSession(); err != nil {
+		l.mu.Lock()
+		l.conn = nil
+		l.mu.Unlock()
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (l *LanIPMI) activateSession() error {
+	caps := &GetAuthCapabilitiesRsp{}
+	if err := l.SendMessage(&GetAuthCapabilitiesReq{Channel: ChannelCurrent, PrivLevel: l.PrivLevel}, caps); err != nil {
+		return errors.Wrap(err, "Get Channel Authentication Capabilities")
+	}
+	authType, err := l.selectAuthType(caps)
+	if err != nil {
+		return err
+	}
+	challenge := &GetSessionChallengeRsp{}
+	if err := l.SendMessage(&GetSessionChallengeReq{AuthType: authType, Username: l.Username}, challenge); err != nil {
+		return errors.Wrap(err, "Get Session Challenge")
+	}
+
+	var outboundSeq [4]byte
+	if _, err := rand.Read(outboundSeq[:]); err != nil {
+		return err
+	}
+	l.setSession(authType, challenge.TemporarySessionId, 0)
+	act := &ActivateSessionRsp{}
+	err = l.SendMessage(&ActivateSessionReq{
+		AuthType:           authType,
+		PrivLevel:          l.PrivLevel,
+		Challenge:          challenge.Challenge,
+		InitialOutboundSeq: binary.LittleEndian.Uint32(outboundSeq[:]) | 1,
+	}, act)
+	if err != nil {
+		l.setSession(AuthTypeNone, 0, 0)
+		return errors.Wrap(err, "Activate Session")
+	}
+	seq := act.InitialInboundSeq
+	if seq == 0 {
+		seq = 1
+	}
+	l.setSession(act.AuthType, act.SessionId, seq)
+
+	if err := l.SendMessage(&SetSessionPrivilegeLevelReq{PrivLevel: l.PrivLevel}, &SetSessionPrivilegeLevelRsp{}); err != nil {
+		l.closeSession()
+		return errors.Wrap(err, "Set Session Privilege Level")
+	}
+	return nil
+}
+
+func (l *LanIPMI) selectAuthType(caps *GetAuthCapabilitiesRsp) (AuthType, error) {
+	authTypes := l.AuthTypes
+	if len(authTypes) == 0 {
+		authTypes = lanAuthTypes
+	}
+	for _, t := range authTypes {
+		if caps.SupportsAuthType(t) {
+			return t, nil
+		}
+	}
+	return 0, errors.Errorf("No supported authentication type, BMC offers 0x%02x", caps.AuthTypeSupport)
+}
+
+func (l *LanIPMI) setSession(authType AuthType, sessionId, seq uint32) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.authType = authType
+	l.sessionId = sessionId
+	l.sessionSeq = seq
+}
+
+func (l *LanIPMI) closeSession() {
+	l.mu.Lock()
+	sessionId := l.sessionId
+	l.mu.Unlock()
+	if sessionId != 0 {
+		_ = l.SendMessage(&CloseSessionReq{SessionId: sessionId}, &EmptyRsp{})
+	}
+	l.setSession(AuthTypeNone, 0, 0)
+}
+
+func (l *LanIPMI) Close() error {
+	if l.IsClose() {
+		return nil
+	}
+	l.closeSession()
+	atomic.StoreInt32(&l.close, 1)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return nil
+	}
+	err := l.conn.Close()
+	l.conn = nil
+	return err
+}
+
+func (l *LanIPMI) IsClose() bool {
+	return atomic.LoadInt32(&l.close) == 1
+}
+
+func (l *LanIPMI) SendMessageContext(ctx context.Context, req Message, resp encoding.BinaryUnmarshaler) error {
+	if l.IsClose() {
+		return errors.New("ipmi is close")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return errors.New("lan session is not open")
+	}
+	l.rqSeq = (l.rqSeq + 1) & 0x3f
+	msg, err := encodeLanMessage(req, l.rqSeq)
+	if err != nil {
+		return err
+	}
+	respData, err := lanExchange(ctx, l.conn, l.Timeout, l.Retries, func() ([]byte, error) {
+		seq := l.sessionSeq
+		if seq != 0 {
+			l.sessionSeq++
+			if l.sessionSeq == 0 {
+				l.sessionSeq = 1
+			}
+		}
+		return buildLanPacket(l.authType, l.sessionId, seq, l.Password, msg), nil
+	}, func(pkt []byte) ([]byte, bool) {
+		hdr, msg, err := parseLanPacket(pkt)
+		if err != nil {
+			return nil, false
+		}
+		if l.authType != AuthTypeNone {
+			// replies inside the session are authenticated like requests
+			if hdr.authType != l.authType || hdr.sessionId != l.sessionId {
+				return nil, false
+			}
+			code := lanAuthCode(hdr.authType, l.Password, hdr.sessionId, hdr.seq, msg)
+			if subtle.ConstantTimeCompare(code, hdr.authCode) != 1 {
+				return nil, false
+			}
+		}
+		return matchLanReply(msg, req, l.rqSeq)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "netfn 0x%02x cmd 0x%02x", uint8(req.NetFn()), uint8(req.CmdId()))
+	}
+	if CompletionCode(respData[0]) != CommandCompleted {
+		return CompletionCode(respData[0])
+	}
+	return resp.UnmarshalBinary(respData[1:])
+}
+
+// lanExchange writes the packet returned by build and waits for a packet
+// accepted by match, building and sending the request again on timeout.
+// Cancelling ctx interrupts the pending read.
+func lanExchange(ctx context.Context, conn net.Conn, timeout time.Duration, retries int,
+	build func() ([]byte, error), match func([]byte) ([]byte, bool)) ([]byte, error) {
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.SetReadDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
+	}
+	buf := make([]byte, 1024)
+	for retry := 0; retry <= retries; retry++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		pkt, err := build()
+		if err != nil {
+			return nil, err
+		}
+		if _, err = conn.Write(pkt); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(timeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err = conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if data, ok := match(buf[:n]); ok {
+				return data, nil
+			}
+		}
+	}
+	return nil, errors.New("Timeout waiting for response")
+}
+
+func buildLanPacket(authType AuthType, sessionId, seq uint32, password string, msg []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{rmcpVersion1, 0x00, rmcpNoAck, rmcpClassIPMI})
+	buf.WriteByte(uint8(authType))
+	binaryWrite(buf, seq)
+	binaryWrite(buf, sessionId)
+	if authType != AuthTypeNone {
+		buf.Write(lanAuthCode(authType, password, sessionId, seq, msg))
+	}
+	buf.WriteByte(uint8(len(msg)))
+	buf.Write(msg)
+	// legacy pad, some NICs drop packets of these lengths
+	switch buf.Len() {
+	case 56, 84, 112, 128, 156:
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// lanAuthCode computes the IPMI 1.5 session header authentication code
+// (section 22.17.1)
+func lanAuthCode(authType AuthType, password string, sessionId, seq uint32, msg []byte) []byte {
+	pass := make([]byte, 16)
+	copy(pass, password)
+	switch authType {
+	case AuthTypeMD5:
+		h := md5.New()
+		h.Write(pass)
+		binaryWrite(h, sessionId)
+		h.Write(msg)
+		binaryWrite(h, seq)
+		h.Write(pass)
+		return h.Sum(nil)
+	default:
+		return pass
+	}
+}
+
+// lanSessionHeader is the IPMI 1.5 session header of a packet
+type lanSessionHeader struct {
+	authType  AuthType
+	seq       uint32
+	sessionId uint32
+	authCode  []byte
+}
+
+// parseLanPacket returns the session header and IPMI message of an
+// IPMI 1.5 packet
+func parseLanPacket(pkt []byte) (lanSessionHeader, []byte, error) {
+	var hdr lanSessionHeader
+	buff := NewByteBuffer(pkt)
+	rmcp, err := buff.PopSlice(4)
+	if err != nil {
+		return hdr, nil, err
+	}
+	if rmcp.b[0] != rmcpVersion1 || rmcp.b[3]&0x1f != rmcpClassIPMI {
+		return hdr, nil, errors.New("not an RMCP IPMI packet")
+	}
+	authType, err := buff.PopUint8()
+	if err != nil {
+		return hdr, nil, err
+	}
+	hdr.authType = AuthType(authType)
+	ids, err := buff.PopSlice(8)
+	if err != nil {
+		return hdr, nil, err
+	}
+	hdr.seq = binary.LittleEndian.Uint32(ids.b)
+	hdr.sessionId = binary.LittleEndian.Uint32(ids.b[4:])
+	if hdr.authType != AuthTypeNone {
+		code, err := buff.PopSlice(16)
+		if err != nil {
+			return hdr, nil, err
+		}
+		hdr.authCode = code.b
+	}
+	length, err := buff.PopUint8()
+	if err != nil {
+		return hdr, nil, err
+	}
+	msg, err := buff.PopSlice(int(length))
+	if err != nil {
+		return hdr, nil, err
+	}
+	return hdr, msg.b, nil
+}
+
+func checksum(data []byte) uint8 {
+	var c uint8
+	for _, b := range data {
+		c += b
+	}
+	return -c
+}
+
+// encodeLanMessage frames a request as an IPMI LAN message (section 13.8).
+// A request for a controller behind the BMC is wrapped in Send Message
+// with tracking (section 22.7), the BMC forwards it on IPMB.
+func encodeLanMessage(req Message, rqSeq uint8) ([]byte, error) {
+	data, err := req.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	channel, slaveAddr, bridged := bridgeTarget(req)
+	if !bridged {
+		return ipmbMessage(bmcSlaveAddr, req.NetFn(), req.Lun(), remoteSwId, rqSeq, req.CmdId(), data), nil
+	}
+	inner := ipmbMessage(slaveAddr, req.NetFn(), req.Lun(), bmcSlaveAddr, rqSeq, req.CmdId(), data)
+	data = append([]byte{0x40 | channel&0x0f}, inner...)
+	return ipmbMessage(bmcSlaveAddr, NetworkFunctionApp, 0, remoteSwId, rqSeq, CommandSendMessage, data), nil
+}
+
+// ipmbMessage frames an IPMB request, the format LAN messages share
+func ipmbMessage(rsAddr uint8, netFn NetworkFunction, lun, rqAddr, rqSeq uint8, cmd Command, data []byte) []byte {
+	msg := make([]byte, 0, 7+len(data))
+	msg = append(msg, rsAddr, uint8(netFn)<<2|lun&0x3)
+	msg = append(msg, checksum(msg))
+	msg = append(msg, rqAddr, rqSeq<<2, uint8(cmd))
+	msg = append(msg, data...)
+	return append(msg, checksum(msg[3:]))
+}
+
+// matchLanReply returns the data (starting with the completion code) of
+// the reply to req, unwrapping the IPMB response of a bridged request
+func matchLanReply(msg []byte, req Message, rqSeq uint8) ([]byte, bool) {
+	if _, _, bridged := bridgeTarget(req); !bridged {
+		return matchLanMessage(msg, rqSeq, req.CmdId())
+	}
+	data, ok := matchLanMessage(msg, rqSeq, CommandSendMessage)
+	if !ok {
+		return nil, false
+	}
+	if len(data) == 1 {
+		// the Send Message completion alone, the bridged response follows
+		// unless the BMC could not forward the request
+		return data, CompletionCode(data[0]) != CommandCompleted
+	}
+	return matchLanMessage(data[1:], rqSeq, req.CmdId())
+}
+
+// matchLanMessage returns the data (starting with the completion code) of
+// an IPMI LAN response message if it answers the request rqSeq/cmd
+func matchLanMessage(msg []byte, rqSeq uint8, cmd Command) ([]byte, bool) {
+	if len(msg) < 8 {
+		return nil, false
+	}
+	if checksum(msg[:3]) != 0 || checksum(msg[3:]) != 0 {
+		return nil, false
+	}
+	if msg[4]>>2 != rqSeq || Command(msg[5]) != cmd {
+		return nil, false
+	}
+	data := make([]byte, len(msg)-7)
+	copy(data, msg[6:len(msg)-1])
+	return data, true
+}
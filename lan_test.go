@@ -0,0 +1,323 @@
+package goipmi
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	lanTestTempSessionId = uint32(0x11223344)
+	lanTestSessionId     = uint32(0x55667788)
+	lanTestInboundSeq    = uint32(0x1000)
+)
+
+var lanTestChallenge = [16]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// lanBmc answers IPMI 1.5 LAN requests on a local UDP socket, checking the
+// session header of every request it receives
+type lanBmc struct {
+	t        *testing.T
+	conn     net.PacketConn
+	authType AuthType
+	username string
+	password string
+	sim      *Simulator
+
+	mu   sync.Mutex
+	cmds []Command
+	// seqs are the session sequence numbers of the requests sent inside
+	// the activated session
+	seqs []uint32
+	// outSeq is the session sequence number of the next reply
+	outSeq uint32
+	// forge makes the responder precede the Get Device ID reply with
+	// replies failing the session authentication
+	forge bool
+}
+
+func newLanBmc(t *testing.T, authType AuthType, username, password string) *lanBmc {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &lanBmc{t: t, conn: conn, authType: authType, username: username, password: password, sim: NewSimulator()}
+	go b.serve()
+	return b
+}
+
+func (b *lanBmc) serve() {
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := b.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		pkts := b.handle(buf[:n])
+		b.mu.Unlock()
+		for _, pkt := range pkts {
+			b.conn.WriteTo(pkt, addr)
+		}
+	}
+}
+
+// wantLanAuthCode is the authentication code of section 22.17.1
+func wantLanAuthCode(authType AuthType, password string, sessionId, seq uint32, msg []byte) []byte {
+	pass := make([]byte, 16)
+	copy(pass, password)
+	if authType == AuthTypePassword {
+		return pass
+	}
+	var ids [8]byte
+	binary.LittleEndian.PutUint32(ids[:4], sessionId)
+	binary.LittleEndian.PutUint32(ids[4:], seq)
+	data := append(append([]byte(nil), pass...), ids[:4]...)
+	data = append(data, msg...)
+	data = append(data, ids[4:]...)
+	data = append(data, pass...)
+	sum := md5.Sum(data)
+	return sum[:]
+}
+
+// lanTestPacket frames msg with an IPMI 1.5 session header
+func lanTestPacket(authType AuthType, sessionId, seq uint32, password string, msg []byte) []byte {
+	pkt := []byte{rmcpVersion1, 0x00, rmcpNoAck, rmcpClassIPMI, uint8(authType)}
+	pkt = appendUint32(pkt, seq)
+	pkt = appendUint32(pkt, sessionId)
+	if authType != AuthTypeNone {
+		pkt = append(pkt, wantLanAuthCode(authType, password, sessionId, seq, msg)...)
+	}
+	pkt = append(pkt, uint8(len(msg)))
+	return append(pkt, msg...)
+}
+
+func (b *lanBmc) handle(pkt []byte) [][]byte {
+	t := b.t
+	if len(pkt) < 14 {
+		t.Errorf("short packet % x", pkt)
+		return nil
+	}
+	authType := AuthType(pkt[4])
+	seq := binary.LittleEndian.Uint32(pkt[5:])
+	sessionId := binary.LittleEndian.Uint32(pkt[9:])
+	rest := pkt[13:]
+	var code []byte
+	if authType != AuthTypeNone {
+		code, rest = rest[:16], rest[16:]
+	}
+	msg := rest[1 : 1+int(rest[0])]
+	if checksum(msg[:3]) != 0 || checksum(msg[3:]) != 0 {
+		t.Errorf("bad checksum % x", msg)
+		return nil
+	}
+	netFn, rqSeq, cmd := NetworkFunction(msg[1]>>2), msg[4]>>2, Command(msg[5])
+	data := msg[6 : len(msg)-1]
+
+	b.cmds = append(b.cmds, cmd)
+
+	var rsp []byte
+	var msgs [][]byte
+	cc := CommandCompleted
+	switch {
+	case netFn == NetworkFunctionApp && cmd == CommandGetAuthCapabilities:
+		if authType != AuthTypeNone || sessionId != 0 || seq != 0 {
+			t.Errorf("Get Channel Authentication Capabilities in session %s %08x seq %d", authType, sessionId, seq)
+		}
+		rsp = []byte{0x01, 1<<AuthTypeNone | 1<<AuthTypeMD5 | 1<<AuthTypePassword, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	case netFn == NetworkFunctionApp && cmd == CommandGetSessionChallenge:
+		if authType != AuthTypeNone || sessionId != 0 || seq != 0 {
+			t.Errorf("Get Session Challenge in session %s %08x seq %d", authType, sessionId, seq)
+		}
+		if AuthType(data[0]) != b.authType || string(bytes.TrimRight(data[1:], "\x00")) != b.username {
+			t.Errorf("Get Session Challenge for %s %q", AuthType(data[0]), data[1:])
+		}
+		rsp = make([]byte, 20)
+		binary.LittleEndian.PutUint32(rsp, lanTestTempSessionId)
+		copy(rsp[4:], lanTestChallenge[:])
+	case netFn == NetworkFunctionApp && cmd == CommandActivateSession:
+		if authType != b.authType || sessionId != lanTestTempSessionId || seq != 0 {
+			t.Errorf("Activate Session in session %s %08x seq %d", authType, sessionId, seq)
+		}
+		if !bytes.Equal(data[2:18], lanTestChallenge[:]) {
+			t.Errorf("Activate Session challenge % x", data[2:18])
+		}
+		rsp = make([]byte, 10)
+		rsp[0] = uint8(b.authType)
+		binary.LittleEndian.PutUint32(rsp[1:], lanTestSessionId)
+		binary.LittleEndian.PutUint32(rsp[5:], lanTestInboundSeq)
+		rsp[9] = uint8(PrivilegeLevelAdministrator)
+		b.outSeq = binary.LittleEndian.Uint32(data[18:])
+	default:
+		if authType != b.authType || sessionId != lanTestSessionId {
+			t.Errorf("command 0x%02x in session %s %08x", cmd, authType, sessionId)
+		}
+		b.seqs = append(b.seqs, seq)
+		switch {
+		case netFn == NetworkFunctionApp && cmd == CommandSetSessionPrivilegeLevel:
+			rsp = []byte{data[0]}
+		case netFn == NetworkFunctionApp && cmd == CommandCloseSession:
+		case netFn == NetworkFunctionApp && cmd == CommandSendMessage:
+			// with tracking the BMC acknowledges the request first
+			rsp = bridgedResponse(b.sim, data)
+			msgs = append(msgs, lanResponseMsg(netFn, rqSeq, cmd, CommandCompleted, nil))
+		default:
+			rsp, cc = b.sim.handle(netFn, cmd, data)
+		}
+	}
+	if authType != AuthTypeNone {
+		if want := wantLanAuthCode(authType, b.password, sessionId, seq, msg); !bytes.Equal(code, want) {
+			t.Errorf("command 0x%02x: got auth code % x, want % x", cmd, code, want)
+		}
+	}
+
+	msgs = append(msgs, lanResponseMsg(netFn, rqSeq, cmd, cc, rsp))
+	var pkts [][]byte
+	for _, rspMsg := range msgs {
+		// replies are authenticated from Activate Session on
+		if authType == AuthTypeNone {
+			pkts = append(pkts, lanTestPacket(AuthTypeNone, sessionId, 0, "", rspMsg))
+			continue
+		}
+		rspSeq := uint32(0)
+		if cmd != CommandActivateSession {
+			rspSeq = b.outSeq
+			b.outSeq++
+		}
+		if b.forge && cmd == CommandGetDeviceID {
+			forged := lanResponseMsg(netFn, rqSeq, cmd, cc, append([]byte{0x99}, rsp[1:]...))
+			pkts = append(pkts,
+				lanTestPacket(AuthTypeNone, sessionId, rspSeq, "", forged),
+				lanTestPacket(authType, sessionId, rspSeq, "guessed", forged),
+				lanTestPacket(authType, sessionId+1, rspSeq, b.password, forged))
+		}
+		pkts = append(pkts, lanTestPacket(authType, sessionId, rspSeq, b.password, rspMsg))
+	}
+	return pkts
+}
+
+// bridgedResponse forwards the IPMB request carried by Send Message to
+// the satellite of sim it addresses and returns the IPMB response
+func bridgedResponse(sim *Simulator, data []byte) []byte {
+	req := data[1:]
+	rsAddr, netFn, lun := req[0], NetworkFunction(req[1]>>2), req[1]&0x3
+	rqAddr, rqSeq, cmd := req[3], req[4]>>2, Command(req[5])
+	rsp, cc := []byte(nil), ErrDestUnavail
+	if sat := sim.satellites[rsAddr]; sat != nil {
+		sat.mu.Lock()
+		rsp, cc = sat.handle(netFn, cmd, req[6:len(req)-1])
+		sat.mu.Unlock()
+	}
+	msg := []byte{rqAddr, uint8(netFn+1)<<2 | lun}
+	msg = append(msg, checksum(msg))
+	msg = append(msg, rsAddr, rqSeq<<2, uint8(cmd), uint8(cc))
+	msg = append(msg, rsp...)
+	return append(msg, checksum(msg[3:]))
+}
+
+// lanResponseMsg frames the response to a LAN request message
+func lanResponseMsg(netFn NetworkFunction, rqSeq uint8, cmd Command, cc CompletionCode, data []byte) []byte {
+	msg := []byte{remoteSwId, uint8(netFn+1) << 2}
+	msg = append(msg, checksum(msg))
+	msg = append(msg, bmcSlaveAddr, rqSeq<<2, uint8(cmd), uint8(cc))
+	msg = append(msg, data...)
+	return append(msg, checksum(msg[3:]))
+}
+
+func TestLanSession(t *testing.T) {
+	for _, authType := range []AuthType{AuthTypeNone, AuthTypeMD5, AuthTypePassword} {
+		b := newLanBmc(t, authType, "admin", "secret")
+		l := NewLanIPMI(b.conn.LocalAddr().String(), "admin", "secret")
+		l.AuthTypes = []AuthType{authType}
+		l.Timeout = time.Second
+		if err := l.Open(); err != nil {
+			t.Fatalf("%s: %v", authType, err)
+		}
+		if _, err := l.GetDeviceId(); err != nil {
+			t.Errorf("%s: %v", authType, err)
+		}
+		if err := l.Close(); err != nil {
+			t.Errorf("%s: %v", authType, err)
+		}
+		b.conn.Close()
+
+		b.mu.Lock()
+		wantCmds := []Command{CommandGetAuthCapabilities, CommandGetSessionChallenge, CommandActivateSession,
+			CommandSetSessionPrivilegeLevel, CommandGetDeviceID, CommandCloseSession}
+		if len(b.cmds) != len(wantCmds) {
+			t.Errorf("%s: got commands %v, want %v", authType, b.cmds, wantCmds)
+		} else {
+			for i := range wantCmds {
+				if b.cmds[i] != wantCmds[i] {
+					t.Errorf("%s: got commands %v, want %v", authType, b.cmds, wantCmds)
+					break
+				}
+			}
+		}
+		if len(b.seqs) != 3 {
+			t.Errorf("%s: got %d requests in the session, want 3", authType, len(b.seqs))
+		}
+		for i, seq := range b.seqs {
+			if want := lanTestInboundSeq + uint32(i); seq != want {
+				t.Errorf("%s: request %d: got sequence number %d, want %d", authType, i, seq, want)
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+func TestLanForgedReply(t *testing.T) {
+	for _, authType := range []AuthType{AuthTypeMD5, AuthTypePassword} {
+		b := newLanBmc(t, authType, "admin", "secret")
+		b.mu.Lock()
+		b.forge = true
+		b.mu.Unlock()
+		l := NewLanIPMI(b.conn.LocalAddr().String(), "admin", "secret")
+		l.AuthTypes = []AuthType{authType}
+		l.Timeout = time.Second
+		if err := l.Open(); err != nil {
+			t.Fatalf("%s: %v", authType, err)
+		}
+		id, err := l.GetDeviceId()
+		if err != nil {
+			t.Errorf("%s: %v", authType, err)
+		} else if id.DeviceId != 0x20 {
+			t.Errorf("%s: accepted a forged reply with device ID 0x%02x", authType, id.DeviceId)
+		}
+		l.Close()
+		b.conn.Close()
+	}
+}
+
+func TestLanBridgedSensor(t *testing.T) {
+	b := newLanBmc(t, AuthTypeMD5, "admin", "secret")
+	defer b.conn.Close()
+	sim, _ := newSatelliteSimulator()
+	b.mu.Lock()
+	b.sim = sim
+	b.mu.Unlock()
+	l := NewLanIPMI(b.conn.LocalAddr().String(), "admin", "secret")
+	l.Timeout = time.Second
+	if err := l.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	values := map[string]float64{}
+	err := l.SdrRepositoryEntries(func(name string, value *float64, unitCode uint8, unit string, sensorType uint8, entityInstance uint8, sensorTypeName string, err error) {
+		if err != nil || value == nil {
+			t.Errorf("%s: value %v, error %v", name, value, err)
+			return
+		}
+		values[name] = *value
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["CPU Temp"] != 45 || values["Sat Temp"] != 30 {
+		t.Errorf("got CPU Temp %v, Sat Temp %v, want 45 and 30", values["CPU Temp"], values["Sat Temp"])
+	}
+}
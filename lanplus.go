@@ -0,0 +1,575 @@
+package goipmi
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"hash"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RMCP+ payload types (section 13.27.3)
+const (
+	payloadTypeIPMI           = uint8(0x00)
+	payloadTypeOpenSessionReq = uint8(0x10)
+	payloadTypeOpenSessionRsp = uint8(0x11)
+	payloadTypeRAKP1          = uint8(0x12)
+	payloadTypeRAKP2          = uint8(0x13)
+	payloadTypeRAKP3          = uint8(0x14)
+	payloadTypeRAKP4          = uint8(0x15)
+
+	payloadEncrypted     = uint8(0x80)
+	payloadAuthenticated = uint8(0x40)
+)
+
+// Authentication algorithms (section 13.28)
+const (
+	AuthAlgRakpNone       = uint8(0x00)
+	AuthAlgRakpHmacSha1   = uint8(0x01)
+	AuthAlgRakpHmacSha256 = uint8(0x03)
+)
+
+// Integrity algorithms (section 13.28.4)
+const (
+	IntegrityAlgNone           = uint8(0x00)
+	IntegrityAlgHmacSha1_96    = uint8(0x01)
+	IntegrityAlgHmacSha256_128 = uint8(0x04)
+)
+
+// Confidentiality algorithms (section 13.28.5)
+const (
+	CryptAlgNone      = uint8(0x00)
+	CryptAlgAesCbc128 = uint8(0x01)
+)
+
+type CipherSuite struct {
+	Id              uint8
+	Auth            uint8
+	Integrity       uint8
+	Confidentiality uint8
+}
+
+// Cipher suite IDs (table 22-20) supported by LanPlusIPMI
+var cipherSuites = map[uint8]CipherSuite{
+	0:  {0, AuthAlgRakpNone, IntegrityAlgNone, CryptAlgNone},
+	1:  {1, AuthAlgRakpHmacSha1, IntegrityAlgNone, CryptAlgNone},
+	2:  {2, AuthAlgRakpHmacSha1, IntegrityAlgHmacSha1_96, CryptAlgNone},
+	3:  {3, AuthAlgRakpHmacSha1, IntegrityAlgHmacSha1_96, CryptAlgAesCbc128},
+	15: {15, AuthAlgRakpHmacSha256, IntegrityAlgNone, CryptAlgNone},
+	16: {16, AuthAlgRakpHmacSha256, IntegrityAlgHmacSha256_128, CryptAlgNone},
+	17: {17, AuthAlgRakpHmacSha256, IntegrityAlgHmacSha256_128, CryptAlgAesCbc128},
+}
+
+// RmcpPlusStatus is the status code of the RMCP+ session setup messages
+type RmcpPlusStatus uint8
+
+var rmcpPlusStatusCodes = map[RmcpPlusStatus]string{
+	0x01: "Insufficient resources to create a session",
+	0x02: "Invalid session ID",
+	0x03: "Invalid payload type",
+	0x04: "Invalid authentication algorithm",
+	0x05: "Invalid integrity algorithm",
+	0x06: "No matching authentication payload",
+	0x07: "No matching integrity payload",
+	0x08: "Inactive session ID",
+	0x09: "Invalid role",
+	0x0a: "Unauthorized role or privilege level requested",
+	0x0b: "Insufficient resources to create a session at the requested role",
+	0x0c: "Invalid name length",
+	0x0d: "Unauthorized name",
+	0x0e: "Unauthorized GUID",
+	0x0f: "Invalid integrity check value",
+	0x10: "Invalid confidentiality algorithm",
+	0x11: "No cipher suite match with proposed security algorithms",
+	0x12: "Illegal or unrecognized parameter",
+}
+
+func (s RmcpPlusStatus) Error() string {
+	if msg, ok := rmcpPlusStatusCodes[s]; ok {
+		return msg
+	}
+	return fmt.Sprintf("RMCP+ Status Code: %X", uint8(s))
+}
+
+// LanPlusIPMI is the Transport for IPMI 2.0 RMCP+ sessions (UDP port 623).
+type LanPlusIPMI struct {
+	*Client
+	// Addr is host or host:port of the BMC, the port defaults to 623
+	Addr     string
+	Username string
+	Password string
+	// Kg is the BMC key, the password is used when empty
+	Kg          []byte
+	CipherSuite uint8
+	PrivLevel   PrivilegeLevel
+	Timeout     time.Duration
+	Retries     int
+
+	mu               sync.Mutex
+	conn             net.Conn
+	suite            CipherSuite
+	consoleSessionId uint32
+	bmcSessionId     uint32
+	sessionSeq       uint32
+	rqSeq            uint8
+	active           bool
+	k1, k2           []byte
+	close            int32
+}
+
+func NewLanPlusIPMI(addr, username, password string) *LanPlusIPMI {
+	l := &LanPlusIPMI{
+		Addr:        addr,
+		Username:    username,
+		Password:    password,
+		CipherSuite: 3,
+		PrivLevel:   PrivilegeLevelAdministrator,
+		Timeout:     defaultLanTimeout,
+		Retries:     defaultLanRetries,
+	}
+	l.Client = NewClient(l)
+	return l
+}
+
+func (l *LanPlusIPMI) Open() error {
+	suite, ok := cipherSuites[l.CipherSuite]
+	if !ok {
+		return errors.Errorf("Unsupported cipher suite %d", l.CipherSuite)
+	}
+	if len(l.Username) > 16 {
+		return errors.Errorf("username too long:%d > 16", len(l.Username))
+	}
+	addr := l.Addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultLanPort)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to connect to %s", addr)
+	}
+	l.mu.Lock()
+	l.conn = conn
+	l.suite = suite
+	l.active = false
+	l.mu.Unlock()
+	atomic.StoreInt32(&l.close, 0)
+	if err := l.openSession(); err != nil {
+		l.mu.Lock()
+		l.conn = nil
+		l.mu.Unlock()
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (l *LanPlusIPMI) openSession() error {
+	caps := &GetAuthCapabilitiesRsp{}
+	err := l.SendMessage(&GetAuthCapabilitiesReq{Channel: ChannelCurrent, PrivLevel: l.PrivLevel, IPMI20: true}, caps)
+	if err != nil {
+		return errors.Wrap(err, "Get Channel Authentication Capabilities")
+	}
+	if !caps.SupportsIPMI20() {
+		return errors.New("BMC does not support IPMI v2.0 RMCP+ sessions")
+	}
+
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	l.consoleSessionId = binary.LittleEndian.Uint32(id[:]) | 1
+	data, err := l.exchangeSetup(payloadTypeOpenSessionReq, payloadTypeOpenSessionRsp, l.openSessionRequest())
+	if err != nil {
+		return errors.Wrap(err, "Open Session")
+	}
+	if len(data) >= 2 && data[1] != 0 {
+		return errors.Wrap(RmcpPlusStatus(data[1]), "Open Session")
+	}
+	if len(data) < 12 {
+		return errors.Wrap(DataTooShort, "Open Session")
+	}
+	if binary.LittleEndian.Uint32(data[4:]) != l.consoleSessionId {
+		return errors.New("Open Session: console session ID mismatch")
+	}
+	l.bmcSessionId = binary.LittleEndian.Uint32(data[8:])
+
+	// RAKP 1 / RAKP 2
+	var rm [16]byte
+	if _, err := rand.Read(rm[:]); err != nil {
+		return err
+	}
+	role := uint8(l.PrivLevel) | 0x10 // name-only lookup
+	rakp1 := make([]byte, 0, 28+len(l.Username))
+	rakp1 = append(rakp1, 0, 0, 0, 0)
+	rakp1 = appendUint32(rakp1, l.bmcSessionId)
+	rakp1 = append(rakp1, rm[:]...)
+	rakp1 = append(rakp1, role, 0, 0, uint8(len(l.Username)))
+	rakp1 = append(rakp1, l.Username...)
+	data, err = l.exchangeSetup(payloadTypeRAKP1, payloadTypeRAKP2, rakp1)
+	if err != nil {
+		return errors.Wrap(err, "RAKP 2")
+	}
+	if len(data) >= 2 && data[1] != 0 {
+		return errors.Wrap(RmcpPlusStatus(data[1]), "RAKP 2")
+	}
+	if len(data) < 40 {
+		return errors.Wrap(DataTooShort, "RAKP 2")
+	}
+	rc := data[8:24]
+	guid := data[24:40]
+	sid := make([]byte, 0, 8)
+	sid = appendUint32(sid, l.consoleSessionId)
+	sid = appendUint32(sid, l.bmcSessionId)
+	user := append([]byte{role, uint8(len(l.Username))}, l.Username...)
+
+	kuid := []byte(l.Password)
+	if l.suite.Auth != AuthAlgRakpNone {
+		expect := l.authHMAC(kuid, sid, rm[:], rc, guid, user)
+		if !hmac.Equal(expect, data[40:]) {
+			return errors.New("RAKP 2: invalid key exchange authentication code, check the password")
+		}
+	}
+
+	// RAKP 3 / RAKP 4
+	var sik []byte
+	rakp3 := make([]byte, 0, 8+32)
+	rakp3 = append(rakp3, 0, 0, 0, 0)
+	rakp3 = appendUint32(rakp3, l.bmcSessionId)
+	if l.suite.Auth != AuthAlgRakpNone {
+		rakp3 = append(rakp3, l.authHMAC(kuid, rc, sid[:4], user)...)
+		kg := l.Kg
+		if len(kg) == 0 {
+			kg = kuid
+		}
+		sik = l.authHMAC(kg, rm[:], rc, user)
+	}
+	data, err = l.exchangeSetup(payloadTypeRAKP3, payloadTypeRAKP4, rakp3)
+	if err != nil {
+		return errors.Wrap(err, "RAKP 4")
+	}
+	if len(data) < 8 {
+		return errors.Wrap(DataTooShort, "RAKP 4")
+	}
+	if data[1] != 0 {
+		return errors.Wrap(RmcpPlusStatus(data[1]), "RAKP 4")
+	}
+	if l.suite.Auth != AuthAlgRakpNone {
+		icv := l.authHMAC(sik, rm[:], sid[4:], guid)[:l.rakp4Len()]
+		if !hmac.Equal(icv, data[8:]) {
+			return errors.New("RAKP 4: invalid integrity check value")
+		}
+		l.k1 = l.authHMAC(sik, bytes.Repeat([]byte{0x01}, len(sik)))
+		l.k2 = l.authHMAC(sik, bytes.Repeat([]byte{0x02}, len(sik)))
+	}
+
+	l.mu.Lock()
+	l.active = true
+	l.sessionSeq = 0
+	l.mu.Unlock()
+	if err := l.SendMessage(&SetSessionPrivilegeLevelReq{PrivLevel: l.PrivLevel}, &SetSessionPrivilegeLevelRsp{}); err != nil {
+		l.closeSession()
+		return errors.Wrap(err, "Set Session Privilege Level")
+	}
+	return nil
+}
+
+func (l *LanPlusIPMI) openSessionRequest() []byte {
+	data := make([]byte, 0, 32)
+	data = append(data, 0, uint8(l.PrivLevel), 0, 0)
+	data = appendUint32(data, l.consoleSessionId)
+	data = append(data, 0x00, 0, 0, 0x08, l.suite.Auth, 0, 0, 0)
+	data = append(data, 0x01, 0, 0, 0x08, l.suite.Integrity, 0, 0, 0)
+	data = append(data, 0x02, 0, 0, 0x08, l.suite.Confidentiality, 0, 0, 0)
+	return data
+}
+
+func (l *LanPlusIPMI) authHMAC(key []byte, data ...[]byte) []byte {
+	var h func() hash.Hash
+	switch l.suite.Auth {
+	case AuthAlgRakpHmacSha256:
+		h = sha256.New
+	default:
+		h = sha1.New
+	}
+	mac := hmac.New(h, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// rakp4Len is the length of the RAKP 4 integrity check value
+func (l *LanPlusIPMI) rakp4Len() int {
+	if l.suite.Auth == AuthAlgRakpHmacSha256 {
+		return 16
+	}
+	return 12
+}
+
+// exchangeSetup sends a session setup payload outside of the session
+// and returns the payload of the matching response
+func (l *LanPlusIPMI) exchangeSetup(payloadType, rspType uint8, payload []byte) ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return nil, errors.New("lan session is not open")
+	}
+	l.rqSeq++
+	tag := l.rqSeq
+	payload[0] = tag
+	return lanExchange(context.Background(), l.conn, l.Timeout, l.Retries, func() ([]byte, error) {
+		return l.buildPacket(payloadType, 0, 0, payload)
+	}, func(pkt []byte) ([]byte, bool) {
+		typ, data, err := l.parsePacket(pkt)
+		if err != nil || typ != rspType || len(data) < 1 || data[0] != tag {
+			return nil, false
+		}
+		return data, true
+	})
+}
+
+func (l *LanPlusIPMI) closeSession() {
+	l.mu.Lock()
+	active := l.active
+	l.mu.Unlock()
+	if active {
+		_ = l.SendMessage(&CloseSessionReq{SessionId: l.bmcSessionId}, &EmptyRsp{})
+	}
+	l.mu.Lock()
+	l.active = false
+	l.k1, l.k2 = nil, nil
+	l.mu.Unlock()
+}
+
+func (l *LanPlusIPMI) Close() error {
+	if l.IsClose() {
+		return nil
+	}
+	l.closeSession()
+	atomic.StoreInt32(&l.close, 1)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return nil
+	}
+	err := l.conn.Close()
+	l.conn = nil
+	return err
+}
+
+func (l *LanPlusIPMI) IsClose() bool {
+	return atomic.LoadInt32(&l.close) == 1
+}
+
+func (l *LanPlusIPMI) SendMessageContext(ctx context.Context, req Message, resp encoding.BinaryUnmarshaler) error {
+	if l.IsClose() {
+		return errors.New("ipmi is close")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return errors.New("lan session is not open")
+	}
+	l.rqSeq = (l.rqSeq + 1) & 0x3f
+	msg, err := encodeLanMessage(req, l.rqSeq)
+	if err != nil {
+		return err
+	}
+	respData, err := lanExchange(ctx, l.conn, l.Timeout, l.Retries, func() ([]byte, error) {
+		if !l.active {
+			// Get Channel Authentication Capabilities is sent in IPMI v1.5 format
+			return buildLanPacket(AuthTypeNone, 0, 0, "", msg), nil
+		}
+		l.sessionSeq++
+		if l.sessionSeq == 0 {
+			l.sessionSeq = 1
+		}
+		return l.buildPacket(payloadTypeIPMI, l.bmcSessionId, l.sessionSeq, msg)
+	}, func(pkt []byte) ([]byte, bool) {
+		var msg []byte
+		if len(pkt) > 4 && AuthType(pkt[4]) == AuthTypeRMCPPlus {
+			typ, data, err := l.parsePacket(pkt)
+			if err != nil || typ != payloadTypeIPMI {
+				return nil, false
+			}
+			msg = data
+		} else if !l.active {
+			// only the IPMI v1.5 Get Channel Authentication Capabilities
+			// reply precedes the session
+			_, data, err := parseLanPacket(pkt)
+			if err != nil {
+				return nil, false
+			}
+			msg = data
+		} else {
+			return nil, false
+		}
+		return matchLanReply(msg, req, l.rqSeq)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "netfn 0x%02x cmd 0x%02x", uint8(req.NetFn()), uint8(req.CmdId()))
+	}
+	if CompletionCode(respData[0]) != CommandCompleted {
+		return CompletionCode(respData[0])
+	}
+	return resp.UnmarshalBinary(respData[1:])
+}
+
+// buildPacket frames an RMCP+ payload (section 13.6), encrypting and
+// signing it once the session is active
+func (l *LanPlusIPMI) buildPacket(payloadType uint8, sessionId, seq uint32, payload []byte) ([]byte, error) {
+	if l.active && l.suite.Confidentiality == CryptAlgAesCbc128 {
+		encrypted, err := l.encrypt(payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = encrypted
+		payloadType |= payloadEncrypted
+	}
+	authenticated := l.active && l.suite.Integrity != IntegrityAlgNone
+	if authenticated {
+		payloadType |= payloadAuthenticated
+	}
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{rmcpVersion1, 0x00, rmcpNoAck, rmcpClassIPMI})
+	buf.WriteByte(uint8(AuthTypeRMCPPlus))
+	buf.WriteByte(payloadType)
+	binaryWrite(buf, sessionId)
+	binaryWrite(buf, seq)
+	binaryWrite(buf, uint16(len(payload)))
+	buf.Write(payload)
+	if authenticated {
+		// integrity pad so authType..next header is a multiple of 4
+		pad := (4 - (buf.Len()-4+2)%4) % 4
+		buf.Write(bytes.Repeat([]byte{0xff}, pad))
+		buf.WriteByte(uint8(pad))
+		buf.WriteByte(rmcpClassIPMI)
+		buf.Write(l.integrityCode(buf.Bytes()[4:]))
+	}
+	return buf.Bytes(), nil
+}
+
+// parsePacket verifies and decrypts an RMCP+ packet returning the payload
+// type and payload
+func (l *LanPlusIPMI) parsePacket(pkt []byte) (uint8, []byte, error) {
+	if len(pkt) < 16 {
+		return 0, nil, DataTooShort
+	}
+	if pkt[0] != rmcpVersion1 || pkt[3]&0x1f != rmcpClassIPMI || AuthType(pkt[4]) != AuthTypeRMCPPlus {
+		return 0, nil, errors.New("not an RMCP+ packet")
+	}
+	payloadType := pkt[5]
+	sessionId := binary.LittleEndian.Uint32(pkt[6:])
+	length := int(binary.LittleEndian.Uint16(pkt[14:]))
+	if len(pkt) < 16+length {
+		return 0, nil, DataTooShort
+	}
+	payload := pkt[16 : 16+length]
+	if l.active {
+		if sessionId != l.consoleSessionId {
+			return 0, nil, errors.New("session ID mismatch")
+		}
+		// a reply must be protected the way the cipher suite protects
+		// requests, anything else is forged or from another session
+		authenticated := l.suite.Integrity != IntegrityAlgNone
+		encrypted := l.suite.Confidentiality != CryptAlgNone
+		if (payloadType&payloadAuthenticated != 0) != authenticated {
+			return 0, nil, errors.New("payload authentication does not match the cipher suite")
+		}
+		if (payloadType&payloadEncrypted != 0) != encrypted {
+			return 0, nil, errors.New("payload encryption does not match the cipher suite")
+		}
+		if authenticated {
+			size := l.integrityLen()
+			if len(pkt) < 16+length+2+size {
+				return 0, nil, DataTooShort
+			}
+			signed := pkt[4 : len(pkt)-size]
+			if !hmac.Equal(l.integrityCode(signed), pkt[len(pkt)-size:]) {
+				return 0, nil, errors.New("invalid integrity check value")
+			}
+		}
+		if encrypted {
+			decrypted, err := l.decrypt(payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			payload = decrypted
+		}
+	}
+	data := make([]byte, len(payload))
+	copy(data, payload)
+	return payloadType & 0x3f, data, nil
+}
+
+func (l *LanPlusIPMI) integrityLen() int {
+	if l.suite.Integrity == IntegrityAlgHmacSha256_128 {
+		return 16
+	}
+	return 12
+}
+
+func (l *LanPlusIPMI) integrityCode(data []byte) []byte {
+	var mac hash.Hash
+	if l.suite.Integrity == IntegrityAlgHmacSha256_128 {
+		mac = hmac.New(sha256.New, l.k1)
+	} else {
+		mac = hmac.New(sha1.New, l.k1)
+	}
+	mac.Write(data)
+	return mac.Sum(nil)[:l.integrityLen()]
+}
+
+// encrypt implements AES-CBC-128 payload encryption (section 13.29)
+func (l *LanPlusIPMI) encrypt(payload []byte) ([]byte, error) {
+	block, err := aes.NewCipher(l.k2[:16])
+	if err != nil {
+		return nil, err
+	}
+	pad := (aes.BlockSize - (len(payload)+1)%aes.BlockSize) % aes.BlockSize
+	plain := make([]byte, 0, len(payload)+pad+1)
+	plain = append(plain, payload...)
+	for i := 1; i <= pad; i++ {
+		plain = append(plain, uint8(i))
+	}
+	plain = append(plain, uint8(pad))
+	out := make([]byte, aes.BlockSize+len(plain))
+	if _, err := rand.Read(out[:aes.BlockSize]); err != nil {
+		return nil, err
+	}
+	cipher.NewCBCEncrypter(block, out[:aes.BlockSize]).CryptBlocks(out[aes.BlockSize:], plain)
+	return out, nil
+}
+
+func (l *LanPlusIPMI) decrypt(payload []byte) ([]byte, error) {
+	if len(payload) < 2*aes.BlockSize || len(payload)%aes.BlockSize != 0 {
+		return nil, errors.Errorf("invalid encrypted payload length %d", len(payload))
+	}
+	block, err := aes.NewCipher(l.k2[:16])
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(payload)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, payload[:aes.BlockSize]).CryptBlocks(plain, payload[aes.BlockSize:])
+	pad := int(plain[len(plain)-1])
+	if pad >= len(plain) {
+		return nil, errors.Errorf("invalid confidentiality pad length %d", pad)
+	}
+	return plain[:len(plain)-pad-1], nil
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, uint8(v), uint8(v>>8), uint8(v>>16), uint8(v>>24))
+}
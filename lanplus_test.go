@@ -0,0 +1,506 @@
+package goipmi
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"hash"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+const lanPlusTestBmcSessionId = uint32(0x0a0b0c0d)
+
+var (
+	lanPlusTestRc   = bytes.Repeat([]byte{0xc5}, 16)
+	lanPlusTestGuid = []byte{
+		0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77,
+		0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff,
+	}
+)
+
+// lanPlusBmc answers RMCP+ session setup and session requests on a local
+// UDP socket. It derives the session keys on its own, following section
+// 13.31 and 13.32, so the client is checked against the specification
+// rather than against itself.
+type lanPlusBmc struct {
+	t        *testing.T
+	conn     net.PacketConn
+	suite    CipherSuite
+	username string
+	password string
+	kg       []byte
+	sim      *Simulator
+
+	mu sync.Mutex
+	// forge makes the responder precede the Get Device ID reply with
+	// unprotected replies claiming another device ID
+	forge            bool
+	forged           [][]byte
+	consoleSessionId uint32
+	rm               []byte
+	user             []byte
+	sik, k1, k2      []byte
+	active           bool
+	cmds             []Command
+	seqs             []uint32
+}
+
+func newLanPlusBmc(t *testing.T, suite CipherSuite, username, password string, kg []byte) *lanPlusBmc {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &lanPlusBmc{t: t, conn: conn, suite: suite, username: username, password: password, kg: kg, sim: NewSimulator()}
+	go b.serve()
+	return b
+}
+
+func (b *lanPlusBmc) serve() {
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := b.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		rsp := b.handle(buf[:n])
+		forged := b.forged
+		b.forged = nil
+		b.mu.Unlock()
+		for _, pkt := range forged {
+			b.conn.WriteTo(pkt, addr)
+		}
+		if rsp != nil {
+			b.conn.WriteTo(rsp, addr)
+		}
+	}
+}
+
+func (b *lanPlusBmc) authHMAC(key []byte, data ...[]byte) []byte {
+	h := sha1.New
+	if b.suite.Auth == AuthAlgRakpHmacSha256 {
+		h = sha256.New
+	}
+	mac := hmac.New(h, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func (b *lanPlusBmc) integrityLen() int {
+	if b.suite.Integrity == IntegrityAlgHmacSha256_128 {
+		return 16
+	}
+	return 12
+}
+
+func (b *lanPlusBmc) integrityCode(data []byte) []byte {
+	var h func() hash.Hash = sha1.New
+	if b.suite.Integrity == IntegrityAlgHmacSha256_128 {
+		h = sha256.New
+	}
+	mac := hmac.New(h, b.k1)
+	mac.Write(data)
+	return mac.Sum(nil)[:b.integrityLen()]
+}
+
+func (b *lanPlusBmc) handle(pkt []byte) []byte {
+	t := b.t
+	if len(pkt) < 5 {
+		t.Errorf("short packet % x", pkt)
+		return nil
+	}
+	if AuthType(pkt[4]) != AuthTypeRMCPPlus {
+		// Get Channel Authentication Capabilities, IPMI v1.5 format
+		_, msg, err := parseLanPacket(pkt)
+		if err != nil || Command(msg[5]) != CommandGetAuthCapabilities {
+			t.Errorf("unexpected IPMI v1.5 packet % x", pkt)
+			return nil
+		}
+		if msg[6]&0x80 == 0 {
+			t.Error("Get Channel Authentication Capabilities without the IPMI v2.0 bit")
+		}
+		b.cmds = append(b.cmds, CommandGetAuthCapabilities)
+		caps := []byte{0x01, 0x80 | 1<<AuthTypeMD5, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00}
+		return buildLanPacket(AuthTypeNone, 0, 0, "", lanResponseMsg(NetworkFunctionApp, msg[4]>>2, CommandGetAuthCapabilities, CommandCompleted, caps))
+	}
+	payloadType := pkt[5]
+	sessionId := binary.LittleEndian.Uint32(pkt[6:])
+	seq := binary.LittleEndian.Uint32(pkt[10:])
+	length := int(binary.LittleEndian.Uint16(pkt[14:]))
+	payload := pkt[16 : 16+length]
+
+	switch payloadType & 0x3f {
+	case payloadTypeOpenSessionReq:
+		b.consoleSessionId = binary.LittleEndian.Uint32(payload[4:])
+		if payload[12] != b.suite.Auth || payload[20] != b.suite.Integrity || payload[28] != b.suite.Confidentiality {
+			t.Errorf("Open Session proposes % x", payload[8:])
+		}
+		rsp := []byte{payload[0], 0x00, uint8(PrivilegeLevelAdministrator), 0x00}
+		rsp = appendUint32(rsp, b.consoleSessionId)
+		rsp = appendUint32(rsp, lanPlusTestBmcSessionId)
+		rsp = append(rsp, payload[8:]...)
+		return b.packet(payloadTypeOpenSessionRsp, rsp)
+	case payloadTypeRAKP1:
+		if binary.LittleEndian.Uint32(payload[4:]) != lanPlusTestBmcSessionId {
+			t.Errorf("RAKP 1 for session %08x", binary.LittleEndian.Uint32(payload[4:]))
+		}
+		b.rm = append([]byte(nil), payload[8:24]...)
+		b.user = append([]byte(nil), payload[24])
+		b.user = append(b.user, payload[27:]...)
+		if string(payload[28:]) != b.username || int(payload[27]) != len(b.username) {
+			t.Errorf("RAKP 1 for user %q", payload[28:])
+		}
+		rsp := []byte{payload[0], 0x00, 0x00, 0x00}
+		rsp = appendUint32(rsp, b.consoleSessionId)
+		rsp = append(rsp, lanPlusTestRc...)
+		rsp = append(rsp, lanPlusTestGuid...)
+		if b.suite.Auth != AuthAlgRakpNone {
+			var sid [8]byte
+			binary.LittleEndian.PutUint32(sid[:], b.consoleSessionId)
+			binary.LittleEndian.PutUint32(sid[4:], lanPlusTestBmcSessionId)
+			rsp = append(rsp, b.authHMAC([]byte(b.password), sid[:], b.rm, lanPlusTestRc, lanPlusTestGuid, b.user)...)
+		}
+		return b.packet(payloadTypeRAKP2, rsp)
+	case payloadTypeRAKP3:
+		rsp := []byte{payload[0], 0x00, 0x00, 0x00}
+		rsp = appendUint32(rsp, b.consoleSessionId)
+		if b.suite.Auth != AuthAlgRakpNone {
+			var sidm [4]byte
+			binary.LittleEndian.PutUint32(sidm[:], b.consoleSessionId)
+			if want := b.authHMAC([]byte(b.password), lanPlusTestRc, sidm[:], b.user); !hmac.Equal(payload[8:], want) {
+				t.Errorf("RAKP 3: got key exchange code % x, want % x", payload[8:], want)
+			}
+			kg := b.kg
+			if kg == nil {
+				kg = []byte(b.password)
+			}
+			b.sik = b.authHMAC(kg, b.rm, lanPlusTestRc, b.user)
+			b.k1 = b.authHMAC(b.sik, bytes.Repeat([]byte{0x01}, len(b.sik)))
+			b.k2 = b.authHMAC(b.sik, bytes.Repeat([]byte{0x02}, len(b.sik)))
+			var sidc [4]byte
+			binary.LittleEndian.PutUint32(sidc[:], lanPlusTestBmcSessionId)
+			icv := b.authHMAC(b.sik, b.rm, sidc[:], lanPlusTestGuid)
+			if b.suite.Auth == AuthAlgRakpHmacSha256 {
+				rsp = append(rsp, icv[:16]...)
+			} else {
+				rsp = append(rsp, icv[:12]...)
+			}
+		}
+		b.active = true
+		return b.packet(payloadTypeRAKP4, rsp)
+	case payloadTypeIPMI:
+	default:
+		t.Errorf("unexpected payload type 0x%02x", payloadType)
+		return nil
+	}
+
+	if sessionId != lanPlusTestBmcSessionId || !b.active {
+		t.Errorf("IPMI payload for session %08x", sessionId)
+		return nil
+	}
+	b.seqs = append(b.seqs, seq)
+	if b.suite.Integrity != IntegrityAlgNone {
+		if payloadType&payloadAuthenticated == 0 {
+			t.Error("IPMI payload is not authenticated")
+			return nil
+		}
+		size := b.integrityLen()
+		code := b.integrityCode(pkt[4 : len(pkt)-size])
+		if got := pkt[len(pkt)-size:]; !hmac.Equal(got, code) {
+			t.Errorf("got integrity code % x, want % x", got, code)
+		}
+		if trailer := pkt[16+length:]; (len(pkt)-4-size)%4 != 0 || trailer[len(trailer)-size-1] != rmcpClassIPMI {
+			t.Errorf("integrity trailer % x", trailer)
+		}
+	}
+	if b.suite.Confidentiality == CryptAlgAesCbc128 {
+		if payloadType&payloadEncrypted == 0 {
+			t.Error("IPMI payload is not encrypted")
+			return nil
+		}
+		block, err := aes.NewCipher(b.k2[:16])
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		plain := make([]byte, len(payload)-aes.BlockSize)
+		cipher.NewCBCDecrypter(block, payload[:aes.BlockSize]).CryptBlocks(plain, payload[aes.BlockSize:])
+		pad := int(plain[len(plain)-1])
+		for i := 0; i < pad; i++ {
+			if plain[len(plain)-1-pad+i] != uint8(i+1) {
+				t.Errorf("confidentiality pad % x", plain[len(plain)-1-pad:])
+				break
+			}
+		}
+		payload = plain[:len(plain)-1-pad]
+	}
+
+	msg := payload
+	if checksum(msg[:3]) != 0 || checksum(msg[3:]) != 0 {
+		t.Errorf("bad checksum % x", msg)
+		return nil
+	}
+	netFn, rqSeq, cmd := NetworkFunction(msg[1]>>2), msg[4]>>2, Command(msg[5])
+	data := msg[6 : len(msg)-1]
+	b.cmds = append(b.cmds, cmd)
+	var rsp []byte
+	cc := CommandCompleted
+	switch {
+	case netFn == NetworkFunctionApp && cmd == CommandSetSessionPrivilegeLevel:
+		rsp = []byte{data[0]}
+	case netFn == NetworkFunctionApp && cmd == CommandCloseSession:
+		if binary.LittleEndian.Uint32(data) != lanPlusTestBmcSessionId {
+			t.Errorf("Close Session for %08x", binary.LittleEndian.Uint32(data))
+		}
+	case netFn == NetworkFunctionApp && cmd == CommandSendMessage:
+		rsp = bridgedResponse(b.sim, data)
+	default:
+		rsp, cc = b.sim.handle(netFn, cmd, data)
+		if b.forge && cmd == CommandGetDeviceID {
+			forged := append([]byte{0x99}, rsp[1:]...)
+			msg := lanResponseMsg(netFn, rqSeq, cmd, cc, forged)
+			// an IPMI v1.5 reply and an RMCP+ reply neither signed nor encrypted
+			plain := []byte{rmcpVersion1, 0x00, rmcpNoAck, rmcpClassIPMI, uint8(AuthTypeRMCPPlus), payloadTypeIPMI}
+			plain = appendUint32(plain, b.consoleSessionId)
+			plain = appendUint32(plain, 0)
+			plain = append(plain, uint8(len(msg)), uint8(len(msg)>>8))
+			plain = append(plain, msg...)
+			b.forged = append(b.forged, buildLanPacket(AuthTypeNone, 0, 0, "", msg), plain)
+		}
+	}
+	return b.packet(payloadTypeIPMI, lanResponseMsg(netFn, rqSeq, cmd, cc, rsp))
+}
+
+// packet frames a response payload to the console, encrypted and signed
+// once the session is active
+func (b *lanPlusBmc) packet(payloadType uint8, payload []byte) []byte {
+	sessionId := uint32(0)
+	if payloadType == payloadTypeIPMI {
+		sessionId = b.consoleSessionId
+		if b.suite.Confidentiality == CryptAlgAesCbc128 {
+			block, _ := aes.NewCipher(b.k2[:16])
+			pad := (aes.BlockSize - (len(payload)+1)%aes.BlockSize) % aes.BlockSize
+			plain := append([]byte(nil), payload...)
+			for i := 1; i <= pad; i++ {
+				plain = append(plain, uint8(i))
+			}
+			plain = append(plain, uint8(pad))
+			out := make([]byte, aes.BlockSize+len(plain))
+			copy(out, bytes.Repeat([]byte{0x5a}, aes.BlockSize))
+			cipher.NewCBCEncrypter(block, out[:aes.BlockSize]).CryptBlocks(out[aes.BlockSize:], plain)
+			payload = out
+			payloadType |= payloadEncrypted
+		}
+		if b.suite.Integrity != IntegrityAlgNone {
+			payloadType |= payloadAuthenticated
+		}
+	}
+	pkt := []byte{rmcpVersion1, 0x00, rmcpNoAck, rmcpClassIPMI, uint8(AuthTypeRMCPPlus), payloadType}
+	pkt = appendUint32(pkt, sessionId)
+	pkt = appendUint32(pkt, 0)
+	pkt = append(pkt, uint8(len(payload)), uint8(len(payload)>>8))
+	pkt = append(pkt, payload...)
+	if payloadType&payloadAuthenticated != 0 {
+		pad := (4 - (len(pkt)-4+2)%4) % 4
+		pkt = append(pkt, bytes.Repeat([]byte{0xff}, pad)...)
+		pkt = append(pkt, uint8(pad), rmcpClassIPMI)
+		pkt = append(pkt, b.integrityCode(pkt[4:])...)
+	}
+	return pkt
+}
+
+func TestLanPlusSession(t *testing.T) {
+	var ids []int
+	for id := range cipherSuites {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	type lanPlusTest struct {
+		suite uint8
+		kg    []byte
+	}
+	var tests []lanPlusTest
+	for _, id := range ids {
+		tests = append(tests, lanPlusTest{suite: uint8(id)})
+	}
+	tests = append(tests,
+		lanPlusTest{suite: 3, kg: []byte("0123456789abcdef0123")},
+		lanPlusTest{suite: 17, kg: []byte("0123456789abcdef0123")})
+
+	for _, test := range tests {
+		b := newLanPlusBmc(t, cipherSuites[test.suite], "admin", "secret", test.kg)
+		l := NewLanPlusIPMI(b.conn.LocalAddr().String(), "admin", "secret")
+		l.CipherSuite = test.suite
+		l.Kg = test.kg
+		l.Timeout = time.Second
+		if err := l.Open(); err != nil {
+			t.Errorf("suite %d: %v", test.suite, err)
+			b.conn.Close()
+			continue
+		}
+		if _, err := l.GetDeviceId(); err != nil {
+			t.Errorf("suite %d: %v", test.suite, err)
+		}
+		if err := l.Close(); err != nil {
+			t.Errorf("suite %d: %v", test.suite, err)
+		}
+		b.conn.Close()
+
+		b.mu.Lock()
+		wantCmds := []Command{CommandGetAuthCapabilities, CommandSetSessionPrivilegeLevel, CommandGetDeviceID, CommandCloseSession}
+		if len(b.cmds) != len(wantCmds) {
+			t.Errorf("suite %d: got commands %v, want %v", test.suite, b.cmds, wantCmds)
+		} else {
+			for i := range wantCmds {
+				if b.cmds[i] != wantCmds[i] {
+					t.Errorf("suite %d: got commands %v, want %v", test.suite, b.cmds, wantCmds)
+					break
+				}
+			}
+		}
+		for i, seq := range b.seqs {
+			if seq != uint32(i+1) {
+				t.Errorf("suite %d: request %d: got sequence number %d, want %d", test.suite, i, seq, i+1)
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+func TestLanPlusOpenSessionStatus(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pkt := buf[:n]
+			if AuthType(pkt[4]) != AuthTypeRMCPPlus {
+				_, msg, _ := parseLanPacket(pkt)
+				caps := []byte{0x01, 0x80, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00}
+				conn.WriteTo(buildLanPacket(AuthTypeNone, 0, 0, "", lanResponseMsg(NetworkFunctionApp, msg[4]>>2, CommandGetAuthCapabilities, CommandCompleted, caps)), addr)
+				continue
+			}
+			// a BMC refusing the session answers the tag and status only
+			rsp := []byte{rmcpVersion1, 0x00, rmcpNoAck, rmcpClassIPMI, uint8(AuthTypeRMCPPlus), payloadTypeOpenSessionRsp}
+			rsp = append(rsp, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0, pkt[16], 0x11)
+			conn.WriteTo(rsp, addr)
+		}
+	}()
+	l := NewLanPlusIPMI(conn.LocalAddr().String(), "admin", "secret")
+	l.Timeout = time.Second
+	err = l.Open()
+	if status, ok := errors.Cause(err).(RmcpPlusStatus); !ok || status != 0x11 {
+		t.Errorf("got %v, want RMCP+ status 0x11", err)
+	}
+}
+
+func TestLanPlusCrypt(t *testing.T) {
+	l := &LanPlusIPMI{suite: cipherSuites[3], k2: bytes.Repeat([]byte{0x2b}, 20)}
+	block, err := aes.NewCipher(l.k2[:16])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n <= 2*aes.BlockSize+1; n++ {
+		payload := bytes.Repeat([]byte{0xa5}, n)
+		// section 13.29: pad bytes 1, 2, .. followed by the pad length
+		plain := append([]byte(nil), payload...)
+		for i := 1; (len(plain)+1)%aes.BlockSize != 0; i++ {
+			plain = append(plain, uint8(i))
+		}
+		plain = append(plain, uint8(len(plain)-n))
+		encrypted := make([]byte, aes.BlockSize+len(plain))
+		copy(encrypted, bytes.Repeat([]byte{0x11}, aes.BlockSize))
+		cipher.NewCBCEncrypter(block, encrypted[:aes.BlockSize]).CryptBlocks(encrypted[aes.BlockSize:], plain)
+		got, err := l.decrypt(encrypted)
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Errorf("decrypt %d bytes: got % x, %v", n, got, err)
+		}
+
+		encrypted, err = l.encrypt(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(encrypted) != aes.BlockSize+len(plain) {
+			t.Errorf("encrypt %d bytes: got %d bytes, want %d", n, len(encrypted), aes.BlockSize+len(plain))
+		}
+		got, err = l.decrypt(encrypted)
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Errorf("encrypt %d bytes: decrypted % x, %v", n, got, err)
+		}
+	}
+}
+
+func TestLanPlusForgedReply(t *testing.T) {
+	for _, suite := range []uint8{2, 3, 17} {
+		b := newLanPlusBmc(t, cipherSuites[suite], "admin", "secret", nil)
+		b.mu.Lock()
+		b.forge = true
+		b.mu.Unlock()
+		l := NewLanPlusIPMI(b.conn.LocalAddr().String(), "admin", "secret")
+		l.CipherSuite = suite
+		l.Timeout = time.Second
+		if err := l.Open(); err != nil {
+			t.Errorf("suite %d: %v", suite, err)
+			b.conn.Close()
+			continue
+		}
+		id, err := l.GetDeviceId()
+		if err != nil {
+			t.Errorf("suite %d: %v", suite, err)
+		} else if id.DeviceId != 0x20 {
+			t.Errorf("suite %d: accepted a forged reply with device ID 0x%02x", suite, id.DeviceId)
+		}
+		l.Close()
+		b.conn.Close()
+	}
+}
+
+func TestLanPlusBridgedSensor(t *testing.T) {
+	b := newLanPlusBmc(t, cipherSuites[3], "admin", "secret", nil)
+	defer b.conn.Close()
+	sim, _ := newSatelliteSimulator()
+	b.mu.Lock()
+	b.sim = sim
+	b.mu.Unlock()
+	l := NewLanPlusIPMI(b.conn.LocalAddr().String(), "admin", "secret")
+	l.Timeout = time.Second
+	if err := l.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	readings, err := l.Sensors(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, r := range readings {
+		if r.Err != nil {
+			t.Errorf("%s: %v", r.Name, r.Err)
+		}
+		if r.Value != nil {
+			values[r.Name] = *r.Value
+		}
+	}
+	if values["CPU Temp"] != 45 || values["Sat Temp"] != 30 {
+		t.Errorf("got CPU Temp %v, Sat Temp %v, want 45 and 30", values["CPU Temp"], values["Sat Temp"])
+	}
+}
@@ -2,321 +2,389 @@
 
 package goipmi
 
-// #include <stdlib.h>
-// #include "ipmi.h"
-import "C"
 import (
+	"context"
 	"encoding"
+	"fmt"
 	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 	"unsafe"
 )
 
+const (
+	localRecvTimeout = 2 * time.Second
+	// localEventBuffer is the number of undelivered events kept per
+	// subscriber before further events are dropped
+	localEventBuffer = 32
+)
+
+var localDevicePaths = []string{"/dev/ipmi%d", "/dev/ipmi/%d", "/dev/ipmidev/%d"}
+
+type localResponse struct {
+	data []byte
+	err  error
+}
+
+// LocalIPMI is the Transport for the in-band Linux OpenIPMI driver.
+// A single reader goroutine dispatches responses to the waiting callers
+// by msgid, so one LocalIPMI can be shared by many goroutines.
 type LocalIPMI struct {
-	ctx   C.ipmi_ctx
-	oem   *uint32
-	close int32
+	*Client
+	// Timeout bounds each request, 0 waits for the context only
+	Timeout time.Duration
+	// Interface is the driver interface number, n in /dev/ipmiN
+	Interface int
+	// DevicePath overrides the device node looked up from Interface
+	DevicePath string
+
+	file    *os.File
+	conn    syscall.RawConn
+	mu      sync.Mutex
+	msgid   int
+	pending map[int]chan localResponse
+	events  map[chan SelEntry]struct{}
+	done    chan struct{}
+	close   int32
 }
 
-func NewLocalIPMI() *LocalIPMI {
-	return &LocalIPMI{}
+// LocalOption configures a LocalIPMI created by NewLocalIPMI
+type LocalOption func(*LocalIPMI)
+
+// WithInterface selects the driver interface number, 0 by default
+func WithInterface(n int) LocalOption {
+	return func(l *LocalIPMI) {
+		l.Interface = n
+	}
 }
 
-func (l *LocalIPMI) Close() error {
+// WithDevicePath opens path instead of looking the device up by interface
+func WithDevicePath(path string) LocalOption {
+	return func(l *LocalIPMI) {
+		l.DevicePath = path
+	}
+}
 
-	C.ipmi_close(&l.ctx)
-	atomic.StoreInt32(&l.close, 1)
-	return nil
+func NewLocalIPMI(opts ...LocalOption) *LocalIPMI {
+	l := &LocalIPMI{Timeout: localRecvTimeout}
+	for _, opt := range opts {
+		opt(l)
+	}
+	l.Client = NewClient(l)
+	return l
 }
 
-func (l *LocalIPMI) IsClose() bool {
-	return atomic.LoadInt32(&l.close) == 1
+// LocalDevice is a local IPMI interface found by LocalDevices
+type LocalDevice struct {
+	Interface int
+	Path      string
+	DeviceId  DevidRsp
 }
 
-func (l *LocalIPMI) getSdrChunk(reservationId, recordId uint16, offset, length uint8) (uint16, []byte, error) {
-	sr := &GetSdrRsp{}
-	err := l.SendMessage(&GetSdrReq{
-		ReservationId: reservationId,
-		RecordId:      recordId,
-		Offset:        offset,
-		BytesToRead:   length,
-	}, sr)
-	if err != nil {
-		return 0, nil, err
+// LocalDevices lists the IPMI device nodes of the local driver together
+// with the Get Device ID identity of the controller behind each of them
+func LocalDevices() ([]LocalDevice, error) {
+	var devices []LocalDevice
+	seen := map[int]bool{}
+	for _, path := range localDevicePaths {
+		matches, err := filepath.Glob(strings.Replace(path, "%d", "[0-9]*", 1))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			var n int
+			if _, err := fmt.Sscanf(match, path, &n); err != nil || seen[n] {
+				continue
+			}
+			seen[n] = true
+			l := NewLocalIPMI(WithInterface(n), WithDevicePath(match))
+			if err := l.Open(); err != nil {
+				continue
+			}
+			id, err := l.GetDeviceId()
+			l.Close()
+			if err != nil {
+				continue
+			}
+			devices = append(devices, LocalDevice{Interface: n, Path: match, DeviceId: *id})
+		}
 	}
-	return sr.NextRecordId, sr.RecordData, nil
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Interface < devices[j].Interface
+	})
+	return devices, nil
 }
 
-func (l *LocalIPMI) getSdrDataHelper(recordId, reservationId uint16) (uint16, []byte, error) {
-	nextId, data, err := l.getSdrChunk(reservationId, recordId, 0, 5)
-	if err != nil {
-		return 0, nil, err
+func (l *LocalIPMI) Close() error {
+	if !atomic.CompareAndSwapInt32(&l.close, 0, 1) || l.file == nil {
+		return nil
 	}
-	buff := NewByteBuffer(data)
-	recordId, err = buff.PopUint16()
-	if err != nil {
-		return 0, nil, err
+	err := l.file.Close()
+	<-l.done
+	return err
+}
+
+func (l *LocalIPMI) IsClose() bool {
+	return atomic.LoadInt32(&l.close) == 1
+}
+
+func (l *LocalIPMI) Open() error {
+	paths := []string{l.DevicePath}
+	if l.DevicePath == "" {
+		paths = paths[:0]
+		for _, path := range localDevicePaths {
+			paths = append(paths, fmt.Sprintf(path, l.Interface))
+		}
 	}
-	var recordPayloadLength uint8
-	_, err = buff.PopUint8()
-	if err != nil {
-		return 0, nil, err
+	var file *os.File
+	var err error
+	for _, path := range paths {
+		file, err = os.OpenFile(path, os.O_RDWR, 0)
+		if err == nil {
+			break
+		}
 	}
-	_, err = buff.PopUint8()
 	if err != nil {
-		return 0, nil, err
+		return errors.Wrap(err, "Failed to open local ipmi driver")
 	}
-	recordPayloadLength, err = buff.PopUint8()
+	conn, err := file.SyscallConn()
 	if err != nil {
-		return 0, nil, err
+		file.Close()
+		return err
 	}
-	recordData := data
-	nextId, data, err = l.getSdrChunk(reservationId, recordId, uint8(len(data)), recordPayloadLength)
-	if err != nil {
-		return 0, nil, err
+	l.file = file
+	l.conn = conn
+	l.pending = map[int]chan localResponse{}
+	l.events = map[chan SelEntry]struct{}{}
+	l.done = make(chan struct{})
+	atomic.StoreInt32(&l.close, 0)
+	go l.readLoop()
+	events := int32(1)
+	if err := l.ioctl(ipmictlSetGetsEventsCmd, unsafe.Pointer(&events)); err != nil {
+		l.Close()
+		return errors.Wrap(err, "IPMICTL_SET_GETS_EVENTS_CMD")
 	}
-	recordData = append(recordData, data...)
-	return nextId, recordData, nil
+	return nil
 }
 
-func (l *LocalIPMI) GetRepositorySdr(recordId, reservationId uint16) (SdrCommon, uint16, error) {
-	nextId, recordData, err := l.getSdrDataHelper(recordId, reservationId)
+func (l *LocalIPMI) ioctl(req uintptr, arg unsafe.Pointer) error {
+	var errno syscall.Errno
+	err := l.conn.Control(func(fd uintptr) {
+		errno = ioctl(fd, req, arg)
+	})
 	if err != nil {
-		return nil, nextId, err
+		return err
 	}
-	c, err := SdrCommonFromData(recordData, nextId)
-	if err != nil {
-		return nil, nextId, err
+	if errno != 0 {
+		return errno
 	}
-	return c, nextId, nil
+	return nil
 }
 
-func (l *LocalIPMI) getSensorReading(number uint8, ownerLun uint8) (*uint8, *int, error) {
-	resp := &GetSensorReadingRsp{}
-	err := l.SendMessage(&GetSensorReadingReq{
-		SensorNumber: number,
-		OwnerLun:     ownerLun,
-	}, resp)
+func (l *LocalIPMI) SendMessageContext(ctx context.Context, req Message, resp encoding.BinaryUnmarshaler) error {
+	if l.IsClose() {
+		return errors.New("ipmi is close")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := req.MarshalBinary()
 	if err != nil {
-		return nil, nil, err
-	}
-	reading := &resp.SensorReading
-	if resp.InitialUpdateInProgress() == 1 {
-		reading = nil
-	}
-	var states *int
-	if resp.States1 != nil {
-		s1 := int(*resp.States1)
-		states = &s1
-		if resp.States2 != nil {
-			s2 := int(*resp.States2)
-			s3 := (*states) | (s2 << 8)
-			states = &(s3)
+		return err
+	}
+	ch := make(chan localResponse, 1)
+	l.mu.Lock()
+	if l.pending == nil {
+		l.mu.Unlock()
+		return errors.New("ipmi is close")
+	}
+	msgid := l.msgid
+	l.msgid++
+	l.pending[msgid] = ch
+	l.mu.Unlock()
+
+	request := ipmiReq{
+		Msgid: msgid,
+		Msg: ipmiMsg{
+			Netfn:   uint8(req.NetFn()),
+			Cmd:     uint8(req.CmdId()),
+			DataLen: uint16(len(data)),
+		},
+	}
+	if channel, slaveAddr, ok := bridgeTarget(req); ok {
+		addr := ipmiIpmbAddr{
+			AddrType:  ipmiIpmbAddrType,
+			Channel:   int16(channel),
+			SlaveAddr: slaveAddr,
+			Lun:       req.Lun(),
 		}
+		request.Addr = unsafe.Pointer(&addr)
+		request.AddrLen = uint32(unsafe.Sizeof(addr))
+	} else {
+		addr := ipmiSystemInterfaceAddr{
+			AddrType: ipmiSystemInterfaceAddrType,
+			Channel:  ipmiBmcChannel,
+			Lun:      req.Lun(),
+		}
+		request.Addr = unsafe.Pointer(&addr)
+		request.AddrLen = uint32(unsafe.Sizeof(addr))
 	}
-	if resp.SensorScanningDisabled() == 0 {
-		return nil, states, nil
+	if len(data) > 0 {
+		request.Msg.Data = unsafe.Pointer(&data[0])
+	}
+	if err := l.ioctl(ipmictlSendCommand, unsafe.Pointer(&request)); err != nil {
+		l.cancel(msgid)
+		return errors.Wrap(err, "IPMICTL_SEND_COMMAND")
 	}
-	return reading, states, nil
-}
 
-func (l *LocalIPMI) GetOem() (uint32, error) {
-	if l.oem != nil {
-		return *l.oem, nil
+	var timeout <-chan time.Time
+	if l.Timeout > 0 {
+		timer := time.NewTimer(l.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
 	}
-	resp := &DevidRsp{}
-	err := l.SendMessage(&GetOem{}, resp)
-	if err != nil {
-		return 0, err
+	var rsp localResponse
+	select {
+	case rsp = <-ch:
+	case <-timeout:
+		l.cancel(msgid)
+		return errors.New("Timeout waiting for response from local ipmi driver")
+	case <-ctx.Done():
+		l.cancel(msgid)
+		return ctx.Err()
 	}
-	oem := uint32(resp.ManufacturerId[2]&0x0F)<<16 | uint32(resp.ManufacturerId[1])<<8 | uint32(resp.ManufacturerId[0])
-	l.oem = &oem
-	return oem, nil
-}
-func (l *LocalIPMI) SelEntries(fun func([]byte) bool) error {
-	resp := &GetReserveSelRsp{}
-	err := l.SendMessage(&GetSelInfoReq{}, resp)
-	if err != nil {
-		return err
+	if rsp.err != nil {
+		return rsp.err
 	}
-	if resp.Date[0] == 0 && resp.Date[1] == 0 {
-		return errors.New("SEL has no entries")
+	if len(rsp.data) < 1 {
+		return DataTooShort
 	}
-	err = l.SendMessage(&ReserveSelReq{}, resp)
-	if err != nil {
-		return err
+	if CompletionCode(rsp.data[0]) != CommandCompleted {
+		return CompletionCode(rsp.data[0])
 	}
-	var nextId uint16
-	var currId uint16
-	var eRsp GetReserveSelRsp
-	nilNextId := 2
-	for nextId != uint16(0xffff) {
-		currId = nextId
-		if err = l.SendMessage(&GetSelEntryReq{
-			Id:          currId,
-			Offset:      0,
-			BytesToRead: 0xff,
-		}, &eRsp); err != nil {
-			return err
+	return resp.UnmarshalBinary(rsp.data[1:])
+}
+
+// Events delivers the platform events the BMC pushes to the driver until
+// ctx is done or the device is closed, then the channel is closed.
+// Events are dropped while the receiver falls behind.
+func (l *LocalIPMI) Events(ctx context.Context) <-chan SelEntry {
+	ch := make(chan SelEntry, localEventBuffer)
+	l.mu.Lock()
+	if l.events == nil {
+		l.mu.Unlock()
+		close(ch)
+		return ch
+	}
+	l.events[ch] = struct{}{}
+	done := l.done
+	l.mu.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
 		}
-		if len(eRsp.Date) < 2 {
-			return DataTooShort
+		l.mu.Lock()
+		if _, ok := l.events[ch]; ok {
+			delete(l.events, ch)
+			close(ch)
 		}
-		nextId = uint16(eRsp.Date[0]) | uint16(eRsp.Date[1])<<8
-		//
-		if nextId == 0 {
-			nilNextId -= 1
-			if nilNextId <= 0 {
-				break
+		l.mu.Unlock()
+	}()
+	return ch
+}
+
+func (l *LocalIPMI) cancel(msgid int) {
+	l.mu.Lock()
+	delete(l.pending, msgid)
+	l.mu.Unlock()
+}
+
+// readLoop receives every message from the driver and hands responses to
+// the caller waiting on the same msgid
+func (l *LocalIPMI) readLoop() {
+	defer close(l.done)
+	for {
+		recvType, msgid, data, err := l.recv()
+		if err != nil && errors.Cause(err) != syscall.EMSGSIZE {
+			l.mu.Lock()
+			pending := l.pending
+			l.pending = nil
+			for ch := range l.events {
+				close(ch)
 			}
+			l.events = nil
+			l.mu.Unlock()
+			if l.IsClose() {
+				err = errors.New("ipmi is close")
+			}
+			for _, ch := range pending {
+				ch <- localResponse{err: err}
+			}
+			return
+		}
+		if recvType == ipmiAsyncEventRecvType {
+			l.dispatchEvent(data)
 			continue
 		}
-		if !fun(eRsp.Date[2:]) {
-			break
+		if recvType != ipmiResponseRecvType {
+			// commands for the software are not consumed
+			continue
+		}
+		l.mu.Lock()
+		ch, ok := l.pending[msgid]
+		delete(l.pending, msgid)
+		l.mu.Unlock()
+		if ok {
+			ch <- localResponse{data: data, err: err}
 		}
-		//fmt.Printf("SEL Record ID %d\n", eRsp.RecordId)
-		//
-		//if eRsp.RecordType == 0xf0 {
-		//	fmt.Printf("Record Type           : Linux kernel panic %d\n", eRsp.RecordType)
-		//	continue
-		//}
-		//fmt.Printf(" Record Type           : %02x", eRsp.RecordType)
-		//if eRsp.RecordType >= 0xc0 {
-		//	if eRsp.RecordType < 0xe0 {
-		//		fmt.Print("(OEM timestamped)")
-		//	} else {
-		//		fmt.Print("(OEM non-timestamped)")
-		//	}
-		//}
-		//fmt.Println("")
-		//if eRsp.RecordType < 0xe0 {
-		//	fmt.Print(" Timestamp             : ")
-		//	if eRsp.RecordType < 0xc0 {
-		//		fmt.Println(time.Unix(int64(eRsp.StandardType.Timestamp), 0))
-		//	} else {
-		//		fmt.Println(time.Unix(int64(eRsp.OemTsType.Timestamp), 0))
-		//	}
-		//}
-		//if eRsp.RecordType >= 0xc0 {
-		//	if eRsp.RecordType < 0xdf {
-		//		fmt.Printf(" Manufactacturer ID    : %02x%02x%02x\n", eRsp.OemTsType.ManfId[0],
-		//			eRsp.OemTsType.ManfId[1], eRsp.OemTsType.ManfId[2])
-		//		fmt.Printf(" OEM Defined           : %v", eRsp.OemTsType.OemDefined)
-		//	} else {
-		//		fmt.Printf(" OEM Defined           : %v", eRsp.OemNotsType.OemDefined)
-		//	}
-		//	continue
-		//}
-		//fmt.Printf(" Generator ID          : %04x\n", eRsp.StandardType.GenId)
-		//fmt.Printf(" EvM Revision          : %04x\n", eRsp.StandardType.EventType)
-		//fmt.Printf(" Sensor Type           : %s\n", getSensorType(eRsp.StandardType.SensorType))
-		//fmt.Printf(" Sensor Numbe          : %d\n", eRsp.StandardType.SensorNum)
-		//fmt.Printf(" Event Type            : %s\n", getEventType(eRsp.StandardType.EventType))
-		//val, ok := EventDirVals[eRsp.StandardType.EventDir]
-		//if ok {
-		//	fmt.Printf(" Event Direction       : %s\n", val)
-		//} else {
-		//	fmt.Printf(" Event Direction       : Unknown (0x%02X)\n", eRsp.StandardType.EventDir)
-		//}
-		//fmt.Printf(" Event Data (RAW)      : %02x%02x%02x\n", eRsp.StandardType.EventData[0], eRsp.StandardType.EventData[1], eRsp.StandardType.EventData[2])
-		//description, err := l.GetEventDesc(eRsp)
-		//if err != nil {
-		//	return err
-		//}
-		//fmt.Printf(" Description       : %s\n", description)
 	}
-	return nil
 }
 
-func (l *LocalIPMI) SdrRepositoryEntries(itemFun func(string, *float64, uint8, string, uint8, uint8, string, error)) error {
-	reservationId, err := l.GetReserveSDRRepoForReserveId()
+func (l *LocalIPMI) dispatchEvent(data []byte) {
+	e, err := UnmarshalSelBinary(data)
 	if err != nil {
-		return err
+		return
 	}
-	recordId := uint16(0)
-	for {
-		c, nextId, err := l.GetRepositorySdr(recordId, reservationId)
-		if recordId == uint16(0xffff) {
-			break
-		}
-
-		if err != nil {
-			if IsUnsupportedSDRTypeErr(err) {
-				recordId = nextId
-				continue
-			}
-			return err
-		}
-		recordId = nextId
-
-		switch t := c.(type) {
-		case *SdrCompactSensorRecord:
-			continue
-		case *SdrFullSensorRecord:
-			value, _, err := l.getSensorReading(t.number, t.ownerLun)
-			if err != nil {
-				itemFun(t.Id, nil, 0, "", 0, 0, "", err)
-				continue
-			}
-			if value != nil {
-				val, err := t.ConvertSensorRawToValue(int(*value))
-				if err != nil {
-					itemFun(t.Id, nil, 0, "", 0, 0, "", err)
-					continue
-				}
-				itemFun(t.Id, &val, t.UnitCode(), t.Unit(), t.SensorTypeCode(), t.entityInstance, t.SensorType(), nil)
-			} else {
-				itemFun(t.Id, nil, 0, "", 0, 0, "", nil)
-			}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ch := range l.events {
+		select {
+		case ch <- e:
 		default:
-			continue
 		}
 	}
-	return nil
 }
 
-func (l *LocalIPMI) GetReserveSDRRepoForReserveId() (uint16, error) {
-	res := &ReserveSdrRepositoryRsp{}
-	err := l.SendMessage(&ReserveSdrRepositoryReq{}, res)
-	return res.ReservationId, err
-}
-
-func (l *LocalIPMI) Open() error {
-	rv := C.ipmi_open(&l.ctx)
-	if rv == 0 {
-		return nil
+// recv blocks until the driver has a message or the device is closed
+func (l *LocalIPMI) recv() (int32, int, []byte, error) {
+	buf := make([]byte, ipmiBufSize)
+	var addr ipmiAddr
+	recv := ipmiRecv{
+		Addr:    unsafe.Pointer(&addr),
+		AddrLen: uint32(unsafe.Sizeof(addr)),
+		Msg: ipmiMsg{
+			Data:    unsafe.Pointer(&buf[0]),
+			DataLen: uint16(len(buf)),
+		},
 	}
-	return errors.Errorf("Failed to open local ipmi driver, errno is %d", rv)
-}
-
-type NetworkFunction uint8
-
-func (l *LocalIPMI) SendMessage(req Message, resp encoding.BinaryUnmarshaler) error {
-	var request C.ipmi_rq
-	var response C.ipmi_rsp
-	request.netfn = C.uchar(req.NetFn())
-	request.lun = C.uchar(req.Lun())
-	request.cmd = C.uchar(req.CmdId())
-	data, err := req.MarshalBinary()
+	var errno syscall.Errno
+	err := l.conn.Read(func(fd uintptr) bool {
+		errno = ioctl(fd, ipmictlReceiveMsgTrunc, unsafe.Pointer(&recv))
+		return errno != syscall.EAGAIN
+	})
 	if err != nil {
-		return nil
-	}
-	if data != nil {
-		rData := C.CBytes(data)
-		defer C.free(rData)
-		request.data = (*C.uchar)(rData)
-		request.data_len = C.ushort(len(data))
-	}
-	if l.IsClose() {
-		return errors.New("ipmi is close")
-	}
-	rv := C.ipmi_send(&l.ctx, &request, &response)
-	if rv != 0 {
-		return errors.Errorf("Faild to write command and recv from local ipmi driver, errno is %d", rv)
+		return 0, 0, nil, err
 	}
-	respData := C.GoBytes(unsafe.Pointer(&response.data), response.data_len)
-	if CompletionCode(respData[0]) != CommandCompleted {
-		return CompletionCode(respData[0])
+	if errno != 0 {
+		return recv.RecvType, recv.Msgid, buf[:recv.Msg.DataLen], errors.Wrap(errno, "IPMICTL_RECEIVE_MSG_TRUNC")
 	}
-	return resp.UnmarshalBinary(respData[1:])
+	return recv.RecvType, recv.Msgid, buf[:recv.Msg.DataLen], nil
 }
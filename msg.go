@@ -1,5 +1,3 @@
-// +build linux
-
 package goipmi
 
 import (
@@ -11,6 +9,8 @@ import (
 	"io"
 )
 
+type NetworkFunction uint8
+
 var (
 	NetworkFunctionChassis     = NetworkFunction(0x00)
 	NetworkFunctionSensorEvent = NetworkFunction(0x04)
@@ -26,6 +26,14 @@ const (
 	CommandGetReserveSDRRepo    = Command(0x22)
 	CommandGetSDR               = Command(0x23)
 	CommandGetSensorReading     = Command(0x2d)
+	CommandSetSensorHysteresis  = Command(0x24)
+	CommandGetSensorHysteresis  = Command(0x25)
+	CommandSetSensorThresholds  = Command(0x26)
+	CommandGetSensorThresholds  = Command(0x27)
+	CommandGetSensorFactors     = Command(0x23)
+	CommandGetDeviceSDRInfo     = Command(0x20)
+	CommandGetDeviceSDR         = Command(0x21)
+	CommandReserveDeviceSDRRepo = Command(0x22)
 )
 
 // Command Number Assignments (table G-1)
@@ -36,6 +44,7 @@ const (
 	CommandActivateSession          = Command(0x3a)
 	CommandSetSessionPrivilegeLevel = Command(0x3b)
 	CommandCloseSession             = Command(0x3c)
+	CommandSendMessage              = Command(0x34)
 	CommandChassisControl           = Command(0x02)
 	CommandChassisStatus            = Command(0x01)
 	CommandSetSystemBootOptions     = Command(0x08)
@@ -83,6 +92,24 @@ type Message interface {
 	encoding.BinaryMarshaler
 }
 
+// BridgedMessage is a request for a controller other than the BMC, which
+// transports route over IPMB. A SlaveAddr of 0 or 0x20 is the BMC itself.
+type BridgedMessage interface {
+	Message
+	Channel() uint8
+	SlaveAddr() uint8
+}
+
+// bridgeTarget returns the IPMB channel and slave address of a request
+// for a controller other than the BMC
+func bridgeTarget(req Message) (channel, slaveAddr uint8, ok bool) {
+	b, ok := req.(BridgedMessage)
+	if !ok || b.SlaveAddr() == 0 || b.SlaveAddr() == bmcSlaveAddr {
+		return 0, 0, false
+	}
+	return b.Channel(), b.SlaveAddr(), true
+}
+
 type GetSelEntryReq struct {
 	Id          uint16
 	Offset      uint8
@@ -152,6 +179,17 @@ type DevidRsp struct {
 	AuxFwRev          [4]uint8
 }
 
+// SensorDevice reports the sensor device bit of the additional device support
+func (r *DevidRsp) SensorDevice() bool {
+	return r.AdtlDeviceSupport&0x01 != 0
+}
+
+// SdrRepositoryDevice reports the SDR repository device bit of the
+// additional device support
+func (r *DevidRsp) SdrRepositoryDevice() bool {
+	return r.AdtlDeviceSupport&0x02 != 0
+}
+
 func (r *DevidRsp) String() string {
 	return fmt.Sprintf("DevidRsp DeviceId=%v ManufacturerId=%v", r.DeviceId, r.ManufacturerId)
 }
@@ -259,6 +297,55 @@ func (r *ReserveSelReq) CmdId() Command {
 	return 0x42
 }
 
+type GetSdrRepositoryInfoReq struct {
+}
+
+func (r *GetSdrRepositoryInfoReq) MarshalBinary() (data []byte, err error) {
+	return nil, nil
+}
+
+func (r *GetSdrRepositoryInfoReq) String() string {
+	return "<GetSdrRepositoryInfoReq>"
+}
+func (r *GetSdrRepositoryInfoReq) Lun() uint8 {
+	return 0
+}
+
+func (r *GetSdrRepositoryInfoReq) NetFn() NetworkFunction {
+	return NetworkFunctionStorge
+}
+func (r *GetSdrRepositoryInfoReq) CmdId() Command {
+	return CommandGetSDRRepositoryInfo
+}
+
+type GetSdrRepositoryInfoRsp struct {
+	Version     uint8
+	RecordCount uint16
+	FreeSpace   uint16
+	// MostRecentAddition and MostRecentErase change whenever the
+	// repository content does
+	MostRecentAddition uint32
+	MostRecentErase    uint32
+	OperationSupport   uint8
+}
+
+func (r *GetSdrRepositoryInfoRsp) String() string {
+	return fmt.Sprintf("<GetSdrRepositoryInfoRsp RecordCount=%d MostRecentAddition=%d MostRecentErase=%d>",
+		r.RecordCount, r.MostRecentAddition, r.MostRecentErase)
+}
+func (r *GetSdrRepositoryInfoRsp) UnmarshalBinary(data []byte) error {
+	if len(data) < 14 {
+		return errors.Errorf("invalid data len:%d < 14", len(data))
+	}
+	r.Version = data[0]
+	r.RecordCount = binary.LittleEndian.Uint16(data[1:])
+	r.FreeSpace = binary.LittleEndian.Uint16(data[3:])
+	r.MostRecentAddition = binary.LittleEndian.Uint32(data[5:])
+	r.MostRecentErase = binary.LittleEndian.Uint32(data[9:])
+	r.OperationSupport = data[13]
+	return nil
+}
+
 type ReserveSdrRepositoryReq struct {
 }
 
@@ -353,6 +440,106 @@ func (r *GetSdrRsp) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
+// GetDeviceSdrInfoReq asks a sensor device for its sensor count, or its
+// Device SDR count when SdrCount is set. The Device SDR requests address
+// the sensor device through their SensorOwner.
+type GetDeviceSdrInfoReq struct {
+	SensorOwner
+	SdrCount bool
+}
+
+func (r *GetDeviceSdrInfoReq) MarshalBinary() ([]byte, error) {
+	if r.SdrCount {
+		return []byte{0x01}, nil
+	}
+	return []byte{0x00}, nil
+}
+
+func (r *GetDeviceSdrInfoReq) String() string {
+	return fmt.Sprintf("<GetDeviceSdrInfoReq SdrCount=%v>", r.SdrCount)
+}
+func (r *GetDeviceSdrInfoReq) NetFn() NetworkFunction {
+	return NetworkFunctionSensorEvent
+}
+func (r *GetDeviceSdrInfoReq) CmdId() Command {
+	return CommandGetDeviceSDRInfo
+}
+
+type GetDeviceSdrInfoRsp struct {
+	Count uint8
+	// Flags bit 7 is set for a dynamic sensor population, bits 3:0 flag
+	// the LUNs that have sensors
+	Flags uint8
+	// PopulationChange is only reported by dynamic sensor devices
+	PopulationChange uint32
+}
+
+func (r *GetDeviceSdrInfoRsp) String() string {
+	return fmt.Sprintf("<GetDeviceSdrInfoRsp Count=%d Flags=0x%02x>", r.Count, r.Flags)
+}
+func (r *GetDeviceSdrInfoRsp) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return errors.Errorf("invalid data len:%d < 2", len(data))
+	}
+	r.Count = data[0]
+	r.Flags = data[1]
+	if len(data) >= 6 {
+		r.PopulationChange = binary.LittleEndian.Uint32(data[2:])
+	}
+	return nil
+}
+
+func (r *GetDeviceSdrInfoRsp) Dynamic() bool {
+	return r.Flags&0x80 != 0
+}
+
+// ReserveDeviceSdrRepositoryReq is answered with a ReserveSdrRepositoryRsp
+type ReserveDeviceSdrRepositoryReq struct {
+	SensorOwner
+}
+
+func (r *ReserveDeviceSdrRepositoryReq) MarshalBinary() (data []byte, err error) {
+	return nil, nil
+}
+
+func (r *ReserveDeviceSdrRepositoryReq) String() string {
+	return "<ReserveDeviceSdrRepositoryReq>"
+}
+func (r *ReserveDeviceSdrRepositoryReq) NetFn() NetworkFunction {
+	return NetworkFunctionSensorEvent
+}
+func (r *ReserveDeviceSdrRepositoryReq) CmdId() Command {
+	return CommandReserveDeviceSDRRepo
+}
+
+// GetDeviceSdrReq reads a Device SDR, it is answered with a GetSdrRsp
+type GetDeviceSdrReq struct {
+	SensorOwner
+	ReservationId uint16
+	RecordId      uint16
+	Offset        uint8
+	BytesToRead   uint8
+}
+
+func (r *GetDeviceSdrReq) String() string {
+	return fmt.Sprintf("<GetDeviceSdrReq ReservationId=%d, RecordId=%d, Offset=%d, BytesToRead=%d>", r.ReservationId, r.RecordId, r.Offset, r.BytesToRead)
+}
+func (r *GetDeviceSdrReq) NetFn() NetworkFunction {
+	return NetworkFunctionSensorEvent
+}
+func (r *GetDeviceSdrReq) CmdId() Command {
+	return CommandGetDeviceSDR
+}
+
+func (r *GetDeviceSdrReq) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 6)
+	binary.LittleEndian.PutUint16(data, r.ReservationId)
+	binary.LittleEndian.PutUint16(data[2:], r.RecordId)
+	data[4] = r.Offset
+	data[5] = r.BytesToRead
+	return data, nil
+}
+
 type GetSensorReadingRsp struct {
 	SensorReading uint8
 	Config        uint8
@@ -389,9 +576,34 @@ func (r *GetSensorReadingRsp) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
+// SensorOwner addresses the controller owning a sensor, the zero value is
+// the BMC. Requests embedding it are BridgedMessages.
+type SensorOwner struct {
+	OwnerLun uint8
+	// OwnerId and OwnerChannel address the sensor owner, 0 for the BMC
+	OwnerId      uint8
+	OwnerChannel uint8
+}
+
+func (o *SensorOwner) Lun() uint8 {
+	return o.OwnerLun & 0x3
+}
+
+func (o *SensorOwner) Channel() uint8 {
+	return o.OwnerChannel
+}
+
+func (o *SensorOwner) SlaveAddr() uint8 {
+	// bit 0 set is a system software id, not an IPMB address
+	if o.OwnerId&0x1 != 0 {
+		return 0
+	}
+	return o.OwnerId
+}
+
 type GetSensorReadingReq struct {
+	SensorOwner
 	SensorNumber uint8
-	OwnerLun     uint8
 }
 
 func (r *GetSensorReadingReq) MarshalBinary() ([]byte, error) {
@@ -403,16 +615,529 @@ func (r *GetSensorReadingReq) MarshalBinary() ([]byte, error) {
 func (r *GetSensorReadingReq) String() string {
 	return fmt.Sprintf("<GetSensorReadingReq SensorNumber=%d>", r.SensorNumber)
 }
-func (r *GetSensorReadingReq) Lun() uint8 {
-	if r.OwnerLun != 0 {
-		return r.OwnerLun
-	}
-	return 0
-}
-
 func (r *GetSensorReadingReq) NetFn() NetworkFunction {
 	return NetworkFunctionSensorEvent
 }
 func (r *GetSensorReadingReq) CmdId() Command {
 	return CommandGetSensorReading
 }
+
+// GetSensorThresholdsReq reads the thresholds set in a sensor
+type GetSensorThresholdsReq struct {
+	SensorOwner
+	SensorNumber uint8
+}
+
+func (r *GetSensorThresholdsReq) MarshalBinary() ([]byte, error) {
+	return []byte{r.SensorNumber}, nil
+}
+
+func (r *GetSensorThresholdsReq) String() string {
+	return fmt.Sprintf("<GetSensorThresholdsReq SensorNumber=%d>", r.SensorNumber)
+}
+func (r *GetSensorThresholdsReq) NetFn() NetworkFunction {
+	return NetworkFunctionSensorEvent
+}
+func (r *GetSensorThresholdsReq) CmdId() Command {
+	return CommandGetSensorThresholds
+}
+
+// GetSensorThresholdsRsp holds the raw thresholds in lnc, lcr, lnr, unc,
+// ucr, unr order, Mask tells which of them are readable
+type GetSensorThresholdsRsp struct {
+	Mask       uint8
+	Thresholds [6]uint8
+}
+
+func (r *GetSensorThresholdsRsp) String() string {
+	return fmt.Sprintf("<GetSensorThresholdsRsp Mask=0x%02x Thresholds=%v>", r.Mask, r.Thresholds)
+}
+func (r *GetSensorThresholdsRsp) UnmarshalBinary(data []byte) error {
+	if len(data) < 7 {
+		return errors.Errorf("invalid data len:%d  < 7", len(data))
+	}
+	r.Mask = data[0] & 0x3f
+	copy(r.Thresholds[:], data[1:7])
+	return nil
+}
+
+// SetSensorThresholdsReq sets the raw thresholds selected by Mask
+type SetSensorThresholdsReq struct {
+	SensorOwner
+	SensorNumber uint8
+	// Mask selects the thresholds to set, in GetSensorThresholdsRsp order
+	Mask       uint8
+	Thresholds [6]uint8
+}
+
+func (r *SetSensorThresholdsReq) MarshalBinary() ([]byte, error) {
+	return append([]byte{r.SensorNumber, r.Mask & 0x3f}, r.Thresholds[:]...), nil
+}
+
+func (r *SetSensorThresholdsReq) String() string {
+	return fmt.Sprintf("<SetSensorThresholdsReq SensorNumber=%d>", r.SensorNumber)
+}
+func (r *SetSensorThresholdsReq) NetFn() NetworkFunction {
+	return NetworkFunctionSensorEvent
+}
+func (r *SetSensorThresholdsReq) CmdId() Command {
+	return CommandSetSensorThresholds
+}
+
+// GetSensorHysteresisReq reads the hysteresis of a threshold sensor
+type GetSensorHysteresisReq struct {
+	SensorOwner
+	SensorNumber uint8
+}
+
+func (r *GetSensorHysteresisReq) MarshalBinary() ([]byte, error) {
+	return []byte{r.SensorNumber, 0xff}, nil
+}
+
+func (r *GetSensorHysteresisReq) String() string {
+	return fmt.Sprintf("<GetSensorHysteresisReq SensorNumber=%d>", r.SensorNumber)
+}
+func (r *GetSensorHysteresisReq) NetFn() NetworkFunction {
+	return NetworkFunctionSensorEvent
+}
+func (r *GetSensorHysteresisReq) CmdId() Command {
+	return CommandGetSensorHysteresis
+}
+
+// GetSensorHysteresisRsp holds the hysteresis in raw reading counts
+type GetSensorHysteresisRsp struct {
+	PositiveGoing uint8
+	NegativeGoing uint8
+}
+
+func (r *GetSensorHysteresisRsp) String() string {
+	return fmt.Sprintf("<GetSensorHysteresisRsp PositiveGoing=%d NegativeGoing=%d>", r.PositiveGoing, r.NegativeGoing)
+}
+func (r *GetSensorHysteresisRsp) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return errors.Errorf("invalid data len:%d  < 2", len(data))
+	}
+	r.PositiveGoing = data[0]
+	r.NegativeGoing = data[1]
+	return nil
+}
+
+// SetSensorHysteresisReq sets the hysteresis in raw reading counts
+type SetSensorHysteresisReq struct {
+	SensorOwner
+	SensorNumber  uint8
+	PositiveGoing uint8
+	NegativeGoing uint8
+}
+
+func (r *SetSensorHysteresisReq) MarshalBinary() ([]byte, error) {
+	return []byte{r.SensorNumber, 0xff, r.PositiveGoing, r.NegativeGoing}, nil
+}
+
+func (r *SetSensorHysteresisReq) String() string {
+	return fmt.Sprintf("<SetSensorHysteresisReq SensorNumber=%d>", r.SensorNumber)
+}
+func (r *SetSensorHysteresisReq) NetFn() NetworkFunction {
+	return NetworkFunctionSensorEvent
+}
+func (r *SetSensorHysteresisReq) CmdId() Command {
+	return CommandSetSensorHysteresis
+}
+
+// GetSensorReadingFactorsReq reads the conversion factors of a non-linear
+// sensor for one raw reading
+type GetSensorReadingFactorsReq struct {
+	SensorOwner
+	SensorNumber uint8
+	Reading      uint8
+}
+
+func (r *GetSensorReadingFactorsReq) MarshalBinary() ([]byte, error) {
+	return []byte{r.SensorNumber, r.Reading}, nil
+}
+
+func (r *GetSensorReadingFactorsReq) String() string {
+	return fmt.Sprintf("<GetSensorReadingFactorsReq SensorNumber=%d Reading=%d>", r.SensorNumber, r.Reading)
+}
+func (r *GetSensorReadingFactorsReq) NetFn() NetworkFunction {
+	return NetworkFunctionSensorEvent
+}
+func (r *GetSensorReadingFactorsReq) CmdId() Command {
+	return CommandGetSensorFactors
+}
+
+// GetSensorReadingFactorsRsp holds the factors valid from the requested
+// reading up to NextReading
+type GetSensorReadingFactorsRsp struct {
+	NextReading uint8
+	Factors     SensorFactors
+}
+
+func (r *GetSensorReadingFactorsRsp) String() string {
+	return fmt.Sprintf("<GetSensorReadingFactorsRsp NextReading=%d Factors=%+v>", r.NextReading, r.Factors)
+}
+func (r *GetSensorReadingFactorsRsp) UnmarshalBinary(data []byte) error {
+	if len(data) < 7 {
+		return errors.Errorf("invalid data len:%d  < 7", len(data))
+	}
+	r.NextReading = data[0]
+	r.Factors = decodeSensorFactors(data[1:7])
+	return nil
+}
+
+type AuthType uint8
+
+// Authentication types (section 13.6)
+const (
+	AuthTypeNone     = AuthType(0x00)
+	AuthTypeMD2      = AuthType(0x01)
+	AuthTypeMD5      = AuthType(0x02)
+	AuthTypePassword = AuthType(0x04)
+	AuthTypeOEM      = AuthType(0x05)
+	AuthTypeRMCPPlus = AuthType(0x06)
+)
+
+func (t AuthType) String() string {
+	switch t {
+	case AuthTypeNone:
+		return "NONE"
+	case AuthTypeMD2:
+		return "MD2"
+	case AuthTypeMD5:
+		return "MD5"
+	case AuthTypePassword:
+		return "PASSWORD"
+	case AuthTypeOEM:
+		return "OEM"
+	case AuthTypeRMCPPlus:
+		return "RMCP+"
+	}
+	return fmt.Sprintf("AuthType(0x%02x)", uint8(t))
+}
+
+type PrivilegeLevel uint8
+
+// Privilege levels (section 6.8)
+const (
+	PrivilegeLevelCallback      = PrivilegeLevel(0x01)
+	PrivilegeLevelUser          = PrivilegeLevel(0x02)
+	PrivilegeLevelOperator      = PrivilegeLevel(0x03)
+	PrivilegeLevelAdministrator = PrivilegeLevel(0x04)
+	PrivilegeLevelOEM           = PrivilegeLevel(0x05)
+)
+
+// ChannelCurrent addresses the channel the request is received on
+const ChannelCurrent = uint8(0x0e)
+
+type GetAuthCapabilitiesReq struct {
+	Channel   uint8
+	PrivLevel PrivilegeLevel
+	// IPMI20 requests the IPMI v2.0 extended capabilities
+	IPMI20 bool
+}
+
+func (r *GetAuthCapabilitiesReq) MarshalBinary() ([]byte, error) {
+	channel := r.Channel & 0x0f
+	if r.IPMI20 {
+		channel |= 0x80
+	}
+	return []byte{channel, uint8(r.PrivLevel)}, nil
+}
+
+func (r *GetAuthCapabilitiesReq) String() string {
+	return fmt.Sprintf("<GetAuthCapabilitiesReq Channel=%d, PrivLevel=%d>", r.Channel, r.PrivLevel)
+}
+func (r *GetAuthCapabilitiesReq) Lun() uint8 {
+	return 0
+}
+
+func (r *GetAuthCapabilitiesReq) NetFn() NetworkFunction {
+	return NetworkFunctionApp
+}
+func (r *GetAuthCapabilitiesReq) CmdId() Command {
+	return CommandGetAuthCapabilities
+}
+
+type GetAuthCapabilitiesRsp struct {
+	ChannelNumber   uint8
+	AuthTypeSupport uint8
+	Status          uint8
+	ExtCapabilities uint8
+	OemId           [3]uint8
+	OemAux          uint8
+}
+
+func (r *GetAuthCapabilitiesRsp) String() string {
+	return fmt.Sprintf("<GetAuthCapabilitiesRsp ChannelNumber=%d, AuthTypeSupport=%02x, Status=%02x>", r.ChannelNumber, r.AuthTypeSupport, r.Status)
+}
+
+// SupportsAuthType reports whether the channel accepts the authentication type
+func (r *GetAuthCapabilitiesRsp) SupportsAuthType(t AuthType) bool {
+	return r.AuthTypeSupport&(1<<t) != 0
+}
+
+// SupportsIPMI20 reports whether the channel accepts RMCP+ sessions
+func (r *GetAuthCapabilitiesRsp) SupportsIPMI20() bool {
+	return r.AuthTypeSupport&0x80 != 0 && r.ExtCapabilities&0x02 != 0
+}
+
+func (r *GetAuthCapabilitiesRsp) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return errors.Errorf("invalid data len:%d < 8", len(data))
+	}
+	r.ChannelNumber = data[0]
+	r.AuthTypeSupport = data[1]
+	r.Status = data[2]
+	r.ExtCapabilities = data[3]
+	copy(r.OemId[:], data[4:7])
+	r.OemAux = data[7]
+	return nil
+}
+
+type GetSessionChallengeReq struct {
+	AuthType AuthType
+	Username string
+}
+
+func (r *GetSessionChallengeReq) MarshalBinary() ([]byte, error) {
+	if len(r.Username) > 16 {
+		return nil, errors.Errorf("username too long:%d > 16", len(r.Username))
+	}
+	data := make([]byte, 17)
+	data[0] = uint8(r.AuthType)
+	copy(data[1:], r.Username)
+	return data, nil
+}
+
+func (r *GetSessionChallengeReq) String() string {
+	return fmt.Sprintf("<GetSessionChallengeReq AuthType=%s, Username=%s>", r.AuthType, r.Username)
+}
+func (r *GetSessionChallengeReq) Lun() uint8 {
+	return 0
+}
+
+func (r *GetSessionChallengeReq) NetFn() NetworkFunction {
+	return NetworkFunctionApp
+}
+func (r *GetSessionChallengeReq) CmdId() Command {
+	return CommandGetSessionChallenge
+}
+
+type GetSessionChallengeRsp struct {
+	TemporarySessionId uint32
+	Challenge          [16]byte
+}
+
+func (r *GetSessionChallengeRsp) String() string {
+	return fmt.Sprintf("<GetSessionChallengeRsp TemporarySessionId=%08x>", r.TemporarySessionId)
+}
+func (r *GetSessionChallengeRsp) UnmarshalBinary(data []byte) error {
+	if len(data) < 20 {
+		return errors.Errorf("invalid data len:%d < 20", len(data))
+	}
+	r.TemporarySessionId = binary.LittleEndian.Uint32(data)
+	copy(r.Challenge[:], data[4:20])
+	return nil
+}
+
+type ActivateSessionReq struct {
+	AuthType           AuthType
+	PrivLevel          PrivilegeLevel
+	Challenge          [16]byte
+	InitialOutboundSeq uint32
+}
+
+func (r *ActivateSessionReq) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 22)
+	data[0] = uint8(r.AuthType)
+	data[1] = uint8(r.PrivLevel)
+	copy(data[2:18], r.Challenge[:])
+	binary.LittleEndian.PutUint32(data[18:], r.InitialOutboundSeq)
+	return data, nil
+}
+
+func (r *ActivateSessionReq) String() string {
+	return fmt.Sprintf("<ActivateSessionReq AuthType=%s, PrivLevel=%d>", r.AuthType, r.PrivLevel)
+}
+func (r *ActivateSessionReq) Lun() uint8 {
+	return 0
+}
+
+func (r *ActivateSessionReq) NetFn() NetworkFunction {
+	return NetworkFunctionApp
+}
+func (r *ActivateSessionReq) CmdId() Command {
+	return CommandActivateSession
+}
+
+type ActivateSessionRsp struct {
+	AuthType          AuthType
+	SessionId         uint32
+	InitialInboundSeq uint32
+	MaxPrivLevel      PrivilegeLevel
+}
+
+func (r *ActivateSessionRsp) String() string {
+	return fmt.Sprintf("<ActivateSessionRsp AuthType=%s, SessionId=%08x, InitialInboundSeq=%d>", r.AuthType, r.SessionId, r.InitialInboundSeq)
+}
+func (r *ActivateSessionRsp) UnmarshalBinary(data []byte) error {
+	if len(data) < 10 {
+		return errors.Errorf("invalid data len:%d < 10", len(data))
+	}
+	r.AuthType = AuthType(data[0] & 0x0f)
+	r.SessionId = binary.LittleEndian.Uint32(data[1:])
+	r.InitialInboundSeq = binary.LittleEndian.Uint32(data[5:])
+	r.MaxPrivLevel = PrivilegeLevel(data[9] & 0x0f)
+	return nil
+}
+
+type SetSessionPrivilegeLevelReq struct {
+	PrivLevel PrivilegeLevel
+}
+
+func (r *SetSessionPrivilegeLevelReq) MarshalBinary() ([]byte, error) {
+	return []byte{uint8(r.PrivLevel)}, nil
+}
+
+func (r *SetSessionPrivilegeLevelReq) String() string {
+	return fmt.Sprintf("<SetSessionPrivilegeLevelReq PrivLevel=%d>", r.PrivLevel)
+}
+func (r *SetSessionPrivilegeLevelReq) Lun() uint8 {
+	return 0
+}
+
+func (r *SetSessionPrivilegeLevelReq) NetFn() NetworkFunction {
+	return NetworkFunctionApp
+}
+func (r *SetSessionPrivilegeLevelReq) CmdId() Command {
+	return CommandSetSessionPrivilegeLevel
+}
+
+type SetSessionPrivilegeLevelRsp struct {
+	PrivLevel PrivilegeLevel
+}
+
+func (r *SetSessionPrivilegeLevelRsp) String() string {
+	return fmt.Sprintf("<SetSessionPrivilegeLevelRsp PrivLevel=%d>", r.PrivLevel)
+}
+func (r *SetSessionPrivilegeLevelRsp) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return errors.Errorf("invalid data len:%d < 1", len(data))
+	}
+	r.PrivLevel = PrivilegeLevel(data[0] & 0x0f)
+	return nil
+}
+
+type CloseSessionReq struct {
+	SessionId uint32
+}
+
+func (r *CloseSessionReq) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, r.SessionId)
+	return data, nil
+}
+
+func (r *CloseSessionReq) String() string {
+	return fmt.Sprintf("<CloseSessionReq SessionId=%08x>", r.SessionId)
+}
+func (r *CloseSessionReq) Lun() uint8 {
+	return 0
+}
+
+func (r *CloseSessionReq) NetFn() NetworkFunction {
+	return NetworkFunctionApp
+}
+func (r *CloseSessionReq) CmdId() Command {
+	return CommandCloseSession
+}
+
+// EmptyRsp is used for commands answering with the completion code only
+type EmptyRsp struct {
+}
+
+func (r *EmptyRsp) String() string {
+	return "<EmptyRsp>"
+}
+func (r *EmptyRsp) UnmarshalBinary(data []byte) error {
+	return nil
+}
+
+type ChassisStatusReq struct {
+}
+
+func (r *ChassisStatusReq) MarshalBinary() (data []byte, err error) {
+	return nil, nil
+}
+
+func (r *ChassisStatusReq) String() string {
+	return "<ChassisStatusReq>"
+}
+func (r *ChassisStatusReq) Lun() uint8 {
+	return 0
+}
+
+func (r *ChassisStatusReq) NetFn() NetworkFunction {
+	return NetworkFunctionChassis
+}
+func (r *ChassisStatusReq) CmdId() Command {
+	return CommandChassisStatus
+}
+
+type ChassisStatusRsp struct {
+	PowerState       uint8
+	LastPowerEvent   uint8
+	MiscChassisState uint8
+}
+
+func (r *ChassisStatusRsp) String() string {
+	return fmt.Sprintf("<ChassisStatusRsp PowerState=%02x, LastPowerEvent=%02x, MiscChassisState=%02x>", r.PowerState, r.LastPowerEvent, r.MiscChassisState)
+}
+
+func (r *ChassisStatusRsp) PowerOn() bool {
+	return r.PowerState&0x01 != 0
+}
+
+func (r *ChassisStatusRsp) UnmarshalBinary(data []byte) error {
+	if len(data) < 3 {
+		return errors.Errorf("invalid data len:%d < 3", len(data))
+	}
+	r.PowerState = data[0]
+	r.LastPowerEvent = data[1]
+	r.MiscChassisState = data[2]
+	return nil
+}
+
+type ChassisControl uint8
+
+// Chassis control values (table 28-4)
+const (
+	ChassisPowerDown    = ChassisControl(0x00)
+	ChassisPowerUp      = ChassisControl(0x01)
+	ChassisPowerCycle   = ChassisControl(0x02)
+	ChassisHardReset    = ChassisControl(0x03)
+	ChassisPulseDiag    = ChassisControl(0x04)
+	ChassisSoftShutdown = ChassisControl(0x05)
+)
+
+type ChassisControlReq struct {
+	Control ChassisControl
+}
+
+func (r *ChassisControlReq) MarshalBinary() ([]byte, error) {
+	return []byte{uint8(r.Control)}, nil
+}
+
+func (r *ChassisControlReq) String() string {
+	return fmt.Sprintf("<ChassisControlReq Control=%d>", r.Control)
+}
+func (r *ChassisControlReq) Lun() uint8 {
+	return 0
+}
+
+func (r *ChassisControlReq) NetFn() NetworkFunction {
+	return NetworkFunctionChassis
+}
+func (r *ChassisControlReq) CmdId() Command {
+	return CommandChassisControl
+}
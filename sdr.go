@@ -1,10 +1,10 @@
-// +build linux
-
 package goipmi
 
 import (
+	"encoding/binary"
 	"github.com/pkg/errors"
 	"math"
+	"strconv"
 )
 
 var (
@@ -54,7 +54,68 @@ var sdrRecordValueBasicUnit []string = []string{
 	"byte", "kilobyte", "megabyte", "gigabyte", "word", "dword",
 	"qword", "line", "hit", "miss", "retry", "reset",
 	"overflow", "underrun", "collision", "packets", "messages",
-	"characters", "error", "correctable error", "uncorrectable error"}
+	"characters", "error", "correctable error", "uncorrectable error",
+	"fatal error", "grams"}
+
+// sdrRecordValueRateUnit is indexed by the rate unit of units 1
+var sdrRecordValueRateUnit = []string{
+	"", "per us", "per ms", "per s", "per minute", "per hour", "per day"}
+
+// Modifier unit operations, units 1 bits [2:1]
+const (
+	UnitModifierNone     = uint8(0)
+	UnitModifierDivide   = uint8(1)
+	UnitModifierMultiply = uint8(2)
+)
+
+// Units is the unit of a sensor reading as given by the units 1, 2 and 3
+// bytes of its record
+type Units struct {
+	Base     uint8
+	Modifier uint8
+	// ModifierOp combines Base and Modifier, one of UnitModifierNone,
+	// UnitModifierDivide and UnitModifierMultiply
+	ModifierOp uint8
+	Rate       uint8
+	Percentage bool
+}
+
+func newUnits(units1, units2, units3 uint8) Units {
+	return Units{
+		Base:       units2,
+		Modifier:   units3,
+		ModifierOp: (units1 >> 1) & 0x3,
+		Rate:       (units1 >> 3) & 0x7,
+		Percentage: units1&0x1 != 0,
+	}
+}
+
+func unitName(code uint8) string {
+	if int(code) < len(sdrRecordValueBasicUnit) {
+		return sdrRecordValueBasicUnit[code]
+	}
+	return "unknown"
+}
+
+// String renders the units the way ipmitool does, "% base/modifier" or
+// "% base * modifier", followed by the rate, e.g. "Watts per hour",
+// "RPM per ms", "CFM * second" or "% Volts"
+func (u Units) String() string {
+	s := unitName(u.Base)
+	switch u.ModifierOp {
+	case UnitModifierDivide:
+		s += "/" + unitName(u.Modifier)
+	case UnitModifierMultiply:
+		s += " * " + unitName(u.Modifier)
+	}
+	if u.Percentage {
+		s = "% " + s
+	}
+	if int(u.Rate) < len(sdrRecordValueRateUnit) && u.Rate != 0 {
+		s += " " + sdrRecordValueRateUnit[u.Rate]
+	}
+	return s
+}
 
 type SdrCommon interface {
 }
@@ -69,7 +130,23 @@ func SdrCommonFromData(recordData []byte, nextId uint16) (SdrCommon, error) {
 		return NewSdrCompactSensorRecord(recordData, nextId)
 	case SDR_TYPE_FULL_SENSOR_RECORD:
 		return NewSdrFullSensorRecord(recordData, nextId)
+	case SDR_TYPE_EVENT_ONLY_SENSOR_RECORD:
+		return NewSdrEventOnlySensorRecord(recordData, nextId)
+	case SDR_TYPE_ENTITY_ASSOCIATION_RECORD:
+		return NewSdrEntityAssociationRecord(recordData, nextId)
+	case SDR_TYPE_FRU_DEVICE_LOCATOR_RECORD:
+		return NewSdrFruDeviceLocatorRecord(recordData, nextId)
+	case SDR_TYPE_MANAGEMENT_CONTROLLER_DEVICE_LOCATOR_RECORD:
+		return NewSdrMcDeviceLocatorRecord(recordData, nextId)
+	case SDR_TYPE_MANAGEMENT_CONTROLLER_CONFIRMATION_RECORD:
+		return NewSdrMcConfirmationRecord(recordData, nextId)
+	case SDR_TYPE_BMC_MESSAGE_CHANNEL_INFO_RECORD:
+		return NewSdrBmcMessageChannelInfoRecord(recordData, nextId)
 	default:
+		// C0h-FFh are all OEM record types
+		if sdrType >= SDR_TYPE_OEM_SENSOR_RECORD {
+			return NewSdrOemRecord(recordData, nextId)
+		}
 		return nil, NewUnsupportedSDRTypeErr(sdrType, nextId)
 	}
 }
@@ -79,6 +156,7 @@ type SdrCompactSensorRecord struct {
 	nextId                    uint16
 	Data                      []byte
 	ownerId, ownerLun, number uint8
+	ownerChannel, fruOwnerLun uint8
 	entityId, entityInstance  uint8
 	Id                        string
 	reserved                  uint32
@@ -118,6 +196,8 @@ func (s *SdrCompactSensorRecord) UnmarshalBinary(data []byte) error {
 	if err != nil {
 		return err
 	}
+	s.ownerChannel = s.ownerLun >> 4
+	s.fruOwnerLun = (s.ownerLun >> 2) & 0x3
 	s.ownerLun = s.ownerLun & 0x3
 	s.number, err = buff.PopUint8() // 8
 	if err != nil {
@@ -197,15 +277,48 @@ func (s *SdrCompactSensorRecord) UnmarshalBinary(data []byte) error {
 	return err
 }
 
+func (s *SdrCompactSensorRecord) MarshalBinary() ([]byte, error) {
+	id, err := idStringBytes(s.Id)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, 26, 26+len(id))
+	body[0] = s.ownerId
+	body[1] = s.ownerChannel<<4 | (s.fruOwnerLun&0x3)<<2 | s.ownerLun&0x3
+	body[2] = s.number
+	body[3] = s.entityId
+	body[4] = s.entityInstance
+	body[5] = s.initialization
+	body[6] = s.capabilities
+	body[7] = s.sensorTypeCode
+	body[8] = s.readingType
+	binary.LittleEndian.PutUint16(body[9:], s.assertionMask)
+	binary.LittleEndian.PutUint16(body[11:], s.deassertionMask)
+	binary.LittleEndian.PutUint16(body[13:], s.discreteReadingMask)
+	body[15] = s.units1
+	body[16] = s.units2
+	body[17] = s.units3
+	binary.LittleEndian.PutUint16(body[18:], s.recordSharing)
+	body[20] = s.positiveGoingHysteresis
+	body[21] = s.negativeGoingHysteresis
+	body[22] = uint8(s.reserved)
+	body[23] = uint8(s.reserved >> 8)
+	body[24] = uint8(s.reserved >> 16)
+	body[25] = s.oem
+	return s.marshal(SDR_TYPE_COMPACT_SENSOR_RECORD, append(body, id...))
+}
+
 type SdrFullSensorRecord struct {
 	Id string
 	SdrCommonHeader
 	ownerId, ownerLun, number                          uint8
+	ownerChannel, fruOwnerLun                          uint8
 	entityId, entityInstance                           uint8
 	nextId                                             uint16
 	Data                                               []byte
 	initialization                                     []string
 	capabilities                                       []string
+	eventMessageControl                                uint8
 	analogCharacteristic                               []string
 	sensorTypeCode                                     uint8
 	eventReadingTypeCode                               uint8
@@ -215,7 +328,7 @@ type SdrFullSensorRecord struct {
 	units1, units2, units3                             uint8
 	analogDataFormat, rateUnit                         uint8
 	modifierUnit, percentage, linearization            uint8
-	tolerance                                          uint8
+	tolerance, sensorDirection                         uint8
 	m                                                  int
 	b                                                  int
 	accuracy                                           int
@@ -251,6 +364,8 @@ func (s *SdrFullSensorRecord) UnmarshalBinary(data []byte) error {
 	if err != nil {
 		return err
 	}
+	s.ownerChannel = s.ownerLun >> 4
+	s.fruOwnerLun = (s.ownerLun >> 2) & 0x3
 	s.ownerLun = s.ownerLun & 0x3
 	s.number, err = buff.PopUint8()
 	if err != nil {
@@ -269,27 +384,11 @@ func (s *SdrFullSensorRecord) UnmarshalBinary(data []byte) error {
 	if err != nil {
 		return err
 	}
-	s.initialization = make([]string, 0, 7)
-	if initialization&0x40 != 0 {
-		s.initialization = append(s.initialization, "scanning")
-	}
-	if initialization&0x20 != 0 {
-		s.initialization = append(s.initialization, "events")
-	}
-	if initialization&0x10 != 0 {
-		s.initialization = append(s.initialization, "thresholds")
-	}
-	if initialization&0x08 != 0 {
-		s.initialization = append(s.initialization, "hysteresis")
-	}
-	if initialization&0x04 != 0 {
-		s.initialization = append(s.initialization, "type")
-	}
-	if initialization&0x02 != 0 {
-		s.initialization = append(s.initialization, "default_event_generation")
-	}
-	if initialization&0x01 != 0 {
-		s.initialization = append(s.initialization, "default_scanning")
+	s.initialization = make([]string, 0, 8)
+	for bit := 7; bit >= 0; bit-- {
+		if initialization&(1<<uint(bit)) != 0 {
+			s.initialization = append(s.initialization, fullSensorInitialization[bit])
+		}
 	}
 
 	c, err := buff.PopUint8()
@@ -297,6 +396,7 @@ func (s *SdrFullSensorRecord) UnmarshalBinary(data []byte) error {
 		return err
 	}
 	s.decodeCapabilities(int(c))
+	s.eventMessageControl = c & 0x3
 
 	s.sensorTypeCode, err = buff.PopUint8()
 	if err != nil {
@@ -333,8 +433,8 @@ func (s *SdrFullSensorRecord) UnmarshalBinary(data []byte) error {
 		return err
 	}
 	s.analogDataFormat = (s.units1 >> 6) & 0x3
-	s.rateUnit = (s.units1 >> 6) >> 0x7
-	s.modifierUnit = (s.units1 >> 1) & 0x2
+	s.rateUnit = (s.units1 >> 3) & 0x7
+	s.modifierUnit = (s.units1 >> 1) & 0x3
 	s.percentage = s.units1 & 0x1
 
 	s.linearization, err = buff.PopUint8()
@@ -343,47 +443,14 @@ func (s *SdrFullSensorRecord) UnmarshalBinary(data []byte) error {
 	}
 	s.linearization = s.linearization & 0x7f
 
-	//
-	m, err := buff.PopUint8()
-	if err != nil {
-		return err
-	}
-	mTol, err := buff.PopUint8()
-	if err != nil {
-		return err
-	}
-	s.m = (int(m) & 0xff) | ((int(mTol) & 0xc0) << 2)
-	s.m = ConvertComplement(s.m, 10)
-	s.tolerance = mTol & 0x3f
-
-	b, err := buff.PopUint8()
-	if err != nil {
-		return err
-	}
-
-	bAcc, err := buff.PopUint8()
-	if err != nil {
-		return err
-	}
-	s.b = (int(b) & 0xff) | ((int(bAcc) & 0xc0) << 2)
-	s.b = ConvertComplement(s.b, 10)
-
-	accAccexp, err := buff.PopUint8()
-	if err != nil {
-		return err
-	}
-	s.accuracy = (int(bAcc) & 0x3f) | ((int(accAccexp) & 0xf0) << 4)
-	s.accuracyExp = (int(accAccexp) & 0x0c) >> 2
-
-	rexpBexp, err := buff.PopUint8()
+	factors, err := buff.PopSlice(6)
 	if err != nil {
 		return err
 	}
-	s.k2 = (int(rexpBexp) & 0xf0) >> 4
-	s.k2 = ConvertComplement(s.k2, 4)
-
-	s.k1 = int(rexpBexp & 0x0f)
-	s.k1 = ConvertComplement(s.k1, 4)
+	f := decodeSensorFactors(factors.b)
+	s.m, s.b, s.k1, s.k2 = f.M, f.B, f.K1, f.K2
+	s.tolerance, s.accuracy, s.accuracyExp = f.Tolerance, f.Accuracy, f.AccuracyExp
+	s.sensorDirection = factors.b[4] & 0x3
 
 	// 31
 	analogCharacteristics, err := buff.PopUint8()
@@ -391,14 +458,10 @@ func (s *SdrFullSensorRecord) UnmarshalBinary(data []byte) error {
 		return err
 	}
 	s.analogCharacteristic = make([]string, 0, 3)
-	if analogCharacteristics&0x01 != 0 {
-		s.analogCharacteristic = append(s.analogCharacteristic, "nominal_reading")
-	}
-	if analogCharacteristics&0x02 != 0 {
-		s.analogCharacteristic = append(s.analogCharacteristic, "normal_max")
-	}
-	if analogCharacteristics&0x04 != 0 {
-		s.analogCharacteristic = append(s.analogCharacteristic, "normal_min")
+	for bit, name := range fullSensorAnalogCharacteristics {
+		if analogCharacteristics&(1<<uint(bit)) != 0 {
+			s.analogCharacteristic = append(s.analogCharacteristic, name)
+		}
 	}
 	s.nominalReading, err = buff.PopUint8()
 	if err != nil {
@@ -471,16 +534,249 @@ func (s *SdrFullSensorRecord) UnmarshalBinary(data []byte) error {
 	}
 	return nil
 }
+
+func (s *SdrFullSensorRecord) MarshalBinary() ([]byte, error) {
+	id, err := idStringBytes(s.Id)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, 42, 42+len(id))
+	body[0] = s.ownerId
+	body[1] = s.ownerChannel<<4 | (s.fruOwnerLun&0x3)<<2 | s.ownerLun&0x3
+	body[2] = s.number
+	body[3] = s.entityId
+	body[4] = s.entityInstance
+	for bit, name := range fullSensorInitialization {
+		if hasName(s.initialization, name) {
+			body[5] |= 1 << uint(bit)
+		}
+	}
+	body[6] = s.eventMessageControl & 0x3
+	for _, name := range s.capabilities {
+		body[6] |= fullSensorCapabilities[name]
+	}
+	body[7] = s.sensorTypeCode
+	body[8] = s.eventReadingTypeCode
+	binary.LittleEndian.PutUint16(body[9:], s.assertionMask)
+	binary.LittleEndian.PutUint16(body[11:], s.deassertionMask)
+	binary.LittleEndian.PutUint16(body[13:], s.discreteReadingMask)
+	body[15] = s.units1
+	body[16] = s.units2
+	body[17] = s.units3
+	body[18] = s.linearization & 0x7f
+	copy(body[19:25], encodeSensorFactors(SensorFactors{
+		M: s.m, B: s.b, K1: s.k1, K2: s.k2,
+		Tolerance: s.tolerance, Accuracy: s.accuracy, AccuracyExp: s.accuracyExp,
+	}))
+	body[23] |= s.sensorDirection & 0x3
+	for bit, name := range fullSensorAnalogCharacteristics {
+		if hasName(s.analogCharacteristic, name) {
+			body[25] |= 1 << uint(bit)
+		}
+	}
+	body[26] = s.nominalReading
+	body[27] = s.normalMaximum
+	body[28] = s.normalMinimum
+	body[29] = s.sensorMaximumReading
+	body[30] = s.sensorMinimumReading
+	for i, name := range []string{"unr", "ucr", "unc", "lnr", "lcr", "lnc"} {
+		body[31+i] = s.threshold[name]
+	}
+	body[37] = s.hysteresis["positive_going"]
+	body[38] = s.hysteresis["negative_going"]
+	binary.LittleEndian.PutUint16(body[39:], s.reserved)
+	body[41] = s.oem
+	return s.marshal(SDR_TYPE_FULL_SENSOR_RECORD, append(body, id...))
+}
+
+func hasName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fullSensorInitialization names the sensor initialization bits, bit 0
+// first
+var fullSensorInitialization = []string{
+	"default_scanning", "default_event_generation", "type", "hysteresis",
+	"thresholds", "events", "scanning", "settable",
+}
+
+// fullSensorAnalogCharacteristics names the analog characteristic flags,
+// bit 0 first
+var fullSensorAnalogCharacteristics = []string{"nominal_reading", "normal_max", "normal_min"}
+
+// sensorThresholds are the threshold names in the bit order of the
+// threshold masks and of the Get Sensor Reading comparison status
+var sensorThresholds = []string{"lnc", "lcr", "lnr", "unc", "ucr", "unr"}
+
+// ReadableThresholds returns the bit mask of the thresholds the sensor
+// reports (bit 0 lnc .. bit 5 unr)
+func (s *SdrFullSensorRecord) ReadableThresholds() uint8 {
+	if s.eventReadingTypeCode != 0x01 {
+		return 0
+	}
+	return uint8(s.discreteReadingMask) & 0x3f
+}
+
+// SettableThresholds returns the bit mask of the thresholds that can be
+// set with Set Sensor Thresholds (bit 0 lnc .. bit 5 unr)
+func (s *SdrFullSensorRecord) SettableThresholds() uint8 {
+	if s.eventReadingTypeCode != 0x01 || !s.hasCapability("threshold_read_and_setable") {
+		return 0
+	}
+	return uint8(s.discreteReadingMask>>8) & 0x3f
+}
+
+func (s *SdrFullSensorRecord) hasCapability(name string) bool {
+	return hasName(s.capabilities, name)
+}
+
+// Thresholds returns the readable thresholds of the record converted to
+// engineering units, keyed by lnc, lcr, lnr, unc, ucr and unr
+func (s *SdrFullSensorRecord) Thresholds() (map[string]float64, error) {
+	return s.thresholds(func(raw uint8) (float64, error) {
+		return s.ConvertSensorRawToValue(int(raw))
+	})
+}
+
+func (s *SdrFullSensorRecord) thresholds(convert func(uint8) (float64, error)) (map[string]float64, error) {
+	mask := s.ReadableThresholds()
+	thresholds := map[string]float64{}
+	for i, name := range sensorThresholds {
+		if mask&(1<<uint(i)) == 0 {
+			continue
+		}
+		val, err := convert(s.threshold[name])
+		if err != nil {
+			return nil, err
+		}
+		thresholds[name] = val
+	}
+	return thresholds, nil
+}
+
 func (s *SdrFullSensorRecord) UnitCode() uint8 {
 	return s.units2
 }
+func (s *SdrFullSensorRecord) Units() Units {
+	return newUnits(s.units1, s.units2, s.units3)
+}
 func (s *SdrFullSensorRecord) Unit() string {
-	if s.units2 >= 0 && s.units2 < uint8(len(sdrRecordValueBasicUnit)) {
-		return sdrRecordValueBasicUnit[s.units2]
+	return s.Units().String()
+}
+
+func (s *SdrCompactSensorRecord) UnitCode() uint8 {
+	return s.units2
+}
+func (s *SdrCompactSensorRecord) Units() Units {
+	return newUnits(s.units1, s.units2, s.units3)
+}
+func (s *SdrCompactSensorRecord) Unit() string {
+	return s.Units().String()
+}
+
+// ShareCount returns the number of sensors described by the record
+func (s *SdrCompactSensorRecord) ShareCount() int {
+	return shareCount(s.recordSharing)
+}
+
+// Shared expands a record shared by several sensors into one record per
+// sensor, with its own sensor number, ID string instance modifier and
+// entity instance. A record that is not shared is returned alone.
+func (s *SdrCompactSensorRecord) Shared() []*SdrCompactSensorRecord {
+	n := s.ShareCount()
+	if n == 1 {
+		return []*SdrCompactSensorRecord{s}
+	}
+	records := make([]*SdrCompactSensorRecord, n)
+	for i := range records {
+		r := *s
+		r.number += uint8(i)
+		r.Id, r.entityInstance = sharedIdentity(s.recordSharing, s.Id, s.entityInstance, i)
+		records[i] = &r
+	}
+	return records
+}
+
+// ShareCount returns the number of sensors described by the record
+func (s *SdrEventOnlySensorRecord) ShareCount() int {
+	return shareCount(s.RecordSharing)
+}
+
+// Shared expands the record like SdrCompactSensorRecord.Shared
+func (s *SdrEventOnlySensorRecord) Shared() []*SdrEventOnlySensorRecord {
+	n := s.ShareCount()
+	if n == 1 {
+		return []*SdrEventOnlySensorRecord{s}
+	}
+	records := make([]*SdrEventOnlySensorRecord, n)
+	for i := range records {
+		r := *s
+		r.Number += uint8(i)
+		r.Id, r.EntityInstance = sharedIdentity(s.RecordSharing, s.Id, s.EntityInstance, i)
+		records[i] = &r
+	}
+	return records
+}
+
+// shareCount decodes the share count of the sensor record sharing field,
+// 0 and 1 both mean a single sensor
+func shareCount(sharing uint16) int {
+	if n := int(sharing & 0x0f); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// sharedIdentity returns the ID string and entity instance of the i-th
+// sensor of a shared record: the ID string gets a numeric or alpha
+// instance modifier appended, starting at the modifier offset, and the
+// entity instance increments when entity instance sharing is set
+func sharedIdentity(sharing uint16, id string, instance uint8, i int) (string, uint8) {
+	modifier := int(sharing>>8&0x7f) + i
+	if (sharing>>4)&0x3 == 0x1 {
+		id += alphaModifier(modifier)
+	} else {
+		id += strconv.Itoa(modifier)
+	}
+	if sharing&0x8000 != 0 {
+		instance += uint8(i)
+	}
+	return id, instance
+}
+
+// alphaModifier renders 0 as A, 25 as Z, 26 as AA and so on
+func alphaModifier(n int) string {
+	s := ""
+	for {
+		s = string(rune('A'+n%26)) + s
+		n = n/26 - 1
+		if n < 0 {
+			return s
+		}
+	}
+}
+
+func (s *SdrCompactSensorRecord) SensorTypeCode() uint8 {
+	return s.sensorTypeCode
+}
+func (s *SdrCompactSensorRecord) SensorType() string {
+	if s.sensorTypeCode < uint8(len(sdrRecordValueSensorType)) {
+		return sdrRecordValueSensorType[s.sensorTypeCode]
 	}
 	return ""
 }
+func (s *SdrCompactSensorRecord) ReadingTypeCode() uint8 {
+	return s.readingType
+}
 
+func (s *SdrFullSensorRecord) ReadingTypeCode() uint8 {
+	return s.eventReadingTypeCode
+}
 func (s *SdrFullSensorRecord) SensorTypeCode() uint8 {
 	return s.sensorTypeCode
 }
@@ -490,6 +786,20 @@ func (s *SdrFullSensorRecord) SensorType() string {
 	}
 	return ""
 }
+
+// fullSensorCapabilities are the sensor capability bits decodeCapabilities
+// names
+var fullSensorCapabilities = map[string]uint8{
+	"ignore_sensor":               0x80,
+	"auto_rearm":                  0x40,
+	"hysteresis_readable":         0x10,
+	"hysteresis_read_and_setable": 0x20,
+	"hysteresis_fixed":            0x30,
+	"threshold_readable":          0x04,
+	"threshold_read_and_setable":  0x08,
+	"threshold_fixed":             0x0c,
+}
+
 func (s *SdrFullSensorRecord) decodeCapabilities(capabilities int) {
 	s.capabilities = make([]string, 0, 10)
 	if capabilities&0x80 != 0 {
@@ -518,8 +828,8 @@ func (s *SdrFullSensorRecord) decodeCapabilities(capabilities int) {
 	var (
 		THRESHOLD_MASK                 = 0x0C
 		THRESHOLD_IS_NOT_SUPPORTED     = 0x00
-		THRESHOLD_IS_READABLE          = 0x08
-		THRESHOLD_IS_READ_AND_SETTABLE = 0x04
+		THRESHOLD_IS_READABLE          = 0x04
+		THRESHOLD_IS_READ_AND_SETTABLE = 0x08
 		THRESHOLD_IS_FIXED             = 0x0C
 	)
 	if capabilities&THRESHOLD_MASK == THRESHOLD_IS_NOT_SUPPORTED {
@@ -533,6 +843,40 @@ func (s *SdrFullSensorRecord) decodeCapabilities(capabilities int) {
 	}
 }
 
+// SensorFactors are the reading conversion factors of a sensor, from its
+// full sensor record or from Get Sensor Reading Factors
+type SensorFactors struct {
+	M, B, K1, K2 int
+	Tolerance    uint8
+	Accuracy     int
+	AccuracyExp  int
+}
+
+// decodeSensorFactors decodes the 6 bytes M, M/tolerance, B, B/accuracy,
+// accuracy/accuracy exp, R exp/B exp
+func decodeSensorFactors(data []byte) SensorFactors {
+	var f SensorFactors
+	f.M = ConvertComplement(int(data[0])|(int(data[1])&0xc0)<<2, 10)
+	f.Tolerance = data[1] & 0x3f
+	f.B = ConvertComplement(int(data[2])|(int(data[3])&0xc0)<<2, 10)
+	f.Accuracy = (int(data[3]) & 0x3f) | (int(data[4])&0xf0)<<2
+	f.AccuracyExp = (int(data[4]) & 0x0c) >> 2
+	f.K2 = ConvertComplement(int(data[5])>>4, 4)
+	f.K1 = ConvertComplement(int(data[5])&0x0f, 4)
+	return f
+}
+
+func encodeSensorFactors(f SensorFactors) []byte {
+	return []byte{
+		uint8(f.M),
+		uint8(f.M>>8&0x3)<<6 | f.Tolerance&0x3f,
+		uint8(f.B),
+		uint8(f.B>>8&0x3)<<6 | uint8(f.Accuracy&0x3f),
+		uint8(f.Accuracy>>6&0xf)<<4 | uint8(f.AccuracyExp&0x3)<<2,
+		uint8(f.K2&0xf)<<4 | uint8(f.K1&0xf),
+	}
+}
+
 func ConvertComplement(value, size int) int {
 	if value&(1<<(uint(size)-1)) != 0 {
 		value = (-(1 << uint(size))) + value
@@ -549,6 +893,15 @@ func deviceIdString(buff *ByteBuffer) (string, error) {
 	return buff.PopString(int(length))
 }
 
+// idStringBytes encodes an ID string as 8-bit ASCII + Latin 1 with its
+// type/length byte
+func idStringBytes(id string) ([]byte, error) {
+	if len(id) > 16 {
+		return nil, errors.Errorf("ID string %q is longer than 16 bytes", id)
+	}
+	return append([]byte{0xc0 | uint8(len(id))}, id...), nil
+}
+
 func parseIdLen(len uint8) uint8 {
 	return len & 0x1f
 }
@@ -584,6 +937,32 @@ func CommonHeader(data []byte) (SdrCommonHeader, error) {
 
 }
 
+func (h SdrCommonHeader) RecordId() uint16 {
+	return h.id
+}
+
+func (h *SdrCommonHeader) SetRecordId(id uint16) {
+	h.id = id
+}
+
+// marshal prefixes body with the record header, the SDR version defaults
+// to 51h
+func (h SdrCommonHeader) marshal(typ uint8, body []byte) ([]byte, error) {
+	if len(body) > 0xff {
+		return nil, errors.Errorf("SDR record 0x%04x: %d bytes is too long", h.id, len(body))
+	}
+	version := h.version
+	if version == 0 {
+		version = 0x51
+	}
+	data := make([]byte, sdrHeaderLength, sdrHeaderLength+len(body))
+	binary.LittleEndian.PutUint16(data, h.id)
+	data[2] = version
+	data[3] = typ
+	data[4] = uint8(len(body))
+	return append(data, body...), nil
+}
+
 const (
 	L_LINEAR = 0
 	L_LN     = 1
@@ -607,7 +986,106 @@ const (
 	DATA_FMT_NONE          = uint8(3)
 )
 
-func (s *SdrFullSensorRecord) ConvertSensorRawToValue(raw int) (float64, error) {
+// ConvertSensorValueToRaw is the inverse of ConvertSensorRawToValue, it
+// returns the raw reading closest to value in the analog data format of
+// the record
+func (s *SdrFullSensorRecord) ConvertSensorValueToRaw(value float64) (uint8, error) {
+	var x float64
+	switch s.linearization & 0x7f {
+	case L_LINEAR:
+		x = value
+	case L_LN:
+		x = math.Exp(value)
+	case L_LOG:
+		x = math.Pow(10, value)
+	case L_LOG2:
+		x = math.Pow(2, value)
+	case L_E:
+		x = math.Log(value)
+	case L_EXP10:
+		x = math.Log10(value)
+	case L_EXP2:
+		x = math.Log2(value)
+	case L_1_X:
+		x = 1.0 / value
+	case L_SQR:
+		// both roots square to value, take the raw reading that converts
+		// back closest to it
+		pos, perr := s.linearToRaw(math.Sqrt(value))
+		neg, nerr := s.linearToRaw(-math.Sqrt(value))
+		if perr != nil || nerr != nil {
+			if perr == nil {
+				return pos, nil
+			}
+			if nerr == nil {
+				return neg, nil
+			}
+			return 0, errors.Wrapf(perr, "%v", value)
+		}
+		pv, _ := s.ConvertSensorRawToValue(int(pos))
+		nv, _ := s.ConvertSensorRawToValue(int(neg))
+		if math.Abs(nv-value) < math.Abs(pv-value) {
+			return neg, nil
+		}
+		return pos, nil
+	case L_CUBE:
+		x = math.Cbrt(value)
+	case L_SQRT:
+		x = math.Pow(value, 2)
+	case L_CUBERT:
+		x = math.Pow(value, 3)
+	default:
+		return 0, errors.Errorf("unknown linearization %d", s.linearization&0x7f)
+	}
+	raw, err := s.linearToRaw(x)
+	if err != nil {
+		return 0, errors.Wrapf(err, "%v", value)
+	}
+	return raw, nil
+}
+
+// linearToRaw inverts the linear part (M*raw + B*10^K1) * 10^K2 of the
+// conversion
+func (s *SdrFullSensorRecord) linearToRaw(x float64) (uint8, error) {
+	if s.m == 0 {
+		return 0, errors.New("sensor has no conversion factor M")
+	}
+	raw := (x/math.Pow(10, float64(s.k2)) - float64(s.b)*math.Pow(10, float64(s.k1))) / float64(s.m)
+	if math.IsNaN(raw) || math.IsInf(raw, 0) {
+		return 0, errors.New("out of sensor range")
+	}
+	r := int(math.Round(raw))
+	switch s.analogDataFormat {
+	case DATA_FMT_UNSIGNED:
+		if r < 0 || r > 0xff {
+			return 0, errors.New("out of sensor range")
+		}
+		return uint8(r), nil
+	case DATA_FMT_1S_COMPLEMENT:
+		if r < -127 || r > 127 {
+			return 0, errors.New("out of sensor range")
+		}
+		if r < 0 {
+			return ^uint8(-r), nil
+		}
+		return uint8(r), nil
+	case DATA_FMT_2S_COMPLEMENT:
+		if r < -128 || r > 127 {
+			return 0, errors.New("out of sensor range")
+		}
+		return uint8(int8(r)), nil
+	default:
+		return 0, errors.New("sensor has no analog reading")
+	}
+}
+
+// NonLinear reports a non-linear sensor (linearization 0x70-0x7f) whose
+// factors depend on the reading and come from Get Sensor Reading Factors
+func (s *SdrFullSensorRecord) NonLinear() bool {
+	return s.linearization >= 0x70
+}
+
+func (s *SdrFullSensorRecord) signedRaw(raw int) int {
 	switch s.analogDataFormat {
 	case DATA_FMT_1S_COMPLEMENT:
 		if raw&0x80 != 0 {
@@ -618,6 +1096,18 @@ func (s *SdrFullSensorRecord) ConvertSensorRawToValue(raw int) (float64, error)
 			raw = -((raw & 0x7f) ^ 0x7f) - 1
 		}
 	}
+	return raw
+}
+
+// ConvertSensorRawToValueWithFactors converts the raw reading of a
+// non-linear sensor with the factors returned for that reading
+func (s *SdrFullSensorRecord) ConvertSensorRawToValueWithFactors(raw int, f SensorFactors) float64 {
+	raw = s.signedRaw(raw)
+	return (float64(f.M)*float64(raw) + (float64(f.B) * math.Pow(10, float64(f.K1)))) * math.Pow(10, float64(f.K2))
+}
+
+func (s *SdrFullSensorRecord) ConvertSensorRawToValue(raw int) (float64, error) {
+	raw = s.signedRaw(raw)
 	raw1 := (float64(s.m)*float64(raw) + (float64(s.b) * math.Pow(10, float64(s.k1)))) * math.Pow(10, float64(s.k2))
 	switch s.linearization & 0x7f {
 	case L_LN:
@@ -648,3 +1138,440 @@ func (s *SdrFullSensorRecord) ConvertSensorRawToValue(raw int) (float64, error)
 		return 0, errors.Errorf("unknown linearization %d", s.linearization&0x7f)
 	}
 }
+
+// SdrEventOnlySensorRecord is an event-only sensor, one that only
+// generates events and cannot be read (SDR type 0x03)
+type SdrEventOnlySensorRecord struct {
+	SdrCommonHeader
+	nextId         uint16
+	Data           []byte
+	OwnerId        uint8
+	OwnerLun       uint8
+	OwnerChannel   uint8
+	FruOwnerLun    uint8
+	Number         uint8
+	EntityId       uint8
+	EntityInstance uint8
+	SensorTypeCode uint8
+	ReadingType    uint8
+	RecordSharing  uint16
+	Oem            uint8
+	Id             string
+}
+
+func NewSdrEventOnlySensorRecord(data []byte, nextId uint16) (SdrCommon, error) {
+	header, err := CommonHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	s := &SdrEventOnlySensorRecord{SdrCommonHeader: header, Data: data, nextId: nextId}
+	return s, s.UnmarshalBinary(data)
+}
+
+func (s *SdrEventOnlySensorRecord) UnmarshalBinary(data []byte) error {
+	if len(data) < 17 {
+		return DataTooShort
+	}
+	s.OwnerId = data[5]
+	s.OwnerChannel = data[6] >> 4
+	s.FruOwnerLun = (data[6] >> 2) & 0x3
+	s.OwnerLun = data[6] & 0x3
+	s.Number = data[7]
+	s.EntityId = data[8]
+	s.EntityInstance = data[9]
+	s.SensorTypeCode = data[10]
+	s.ReadingType = data[11]
+	s.RecordSharing = uint16(data[12]) | uint16(data[13])<<8
+	s.Oem = data[15]
+	var err error
+	s.Id, err = deviceIdString(NewByteBuffer(data[16:]))
+	return err
+}
+
+func (s *SdrEventOnlySensorRecord) MarshalBinary() ([]byte, error) {
+	id, err := idStringBytes(s.Id)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, 11, 11+len(id))
+	body[0] = s.OwnerId
+	body[1] = s.OwnerChannel<<4 | (s.FruOwnerLun&0x3)<<2 | s.OwnerLun&0x3
+	body[2] = s.Number
+	body[3] = s.EntityId
+	body[4] = s.EntityInstance
+	body[5] = s.SensorTypeCode
+	body[6] = s.ReadingType
+	binary.LittleEndian.PutUint16(body[7:], s.RecordSharing)
+	body[10] = s.Oem
+	return s.marshal(SDR_TYPE_EVENT_ONLY_SENSOR_RECORD, append(body, id...))
+}
+
+func (s *SdrEventOnlySensorRecord) SensorType() string {
+	if s.SensorTypeCode < uint8(len(sdrRecordValueSensorType)) {
+		return sdrRecordValueSensorType[s.SensorTypeCode]
+	}
+	return ""
+}
+
+// EntityRef is an entity id/instance pair
+type EntityRef struct {
+	Id       uint8
+	Instance uint8
+	// Owner is the slave address of the controller a device-relative
+	// instance is relative to, 0 for system-relative instances
+	Owner uint8
+}
+
+// SdrEntityAssociationRecord lists the entities contained in a container
+// entity (SDR type 0x08)
+type SdrEntityAssociationRecord struct {
+	SdrCommonHeader
+	nextId    uint16
+	Data      []byte
+	Container EntityRef
+	// Range is set when Entities holds two ranges, first..second and
+	// third..fourth, instead of a list of up to four entities
+	Range bool
+	// Linked is set when further association records exist for Container
+	Linked bool
+	// PresenceSensorAlwaysAccessed is set when the presence of the
+	// entities must be read from their sensors instead of being assumed
+	PresenceSensorAlwaysAccessed bool
+	Entities                     [4]EntityRef
+}
+
+func NewSdrEntityAssociationRecord(data []byte, nextId uint16) (SdrCommon, error) {
+	header, err := CommonHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	s := &SdrEntityAssociationRecord{SdrCommonHeader: header, Data: data, nextId: nextId}
+	return s, s.UnmarshalBinary(data)
+}
+
+func (s *SdrEntityAssociationRecord) UnmarshalBinary(data []byte) error {
+	if len(data) < 16 {
+		return DataTooShort
+	}
+	s.Container = EntityRef{Id: data[5], Instance: data[6]}
+	s.Range = data[7]&0x80 != 0
+	s.Linked = data[7]&0x40 != 0
+	s.PresenceSensorAlwaysAccessed = data[7]&0x20 != 0
+	for i := range s.Entities {
+		s.Entities[i] = EntityRef{Id: data[8+2*i], Instance: data[9+2*i]}
+	}
+	return nil
+}
+
+func (s *SdrEntityAssociationRecord) MarshalBinary() ([]byte, error) {
+	body := make([]byte, 11)
+	body[0] = s.Container.Id
+	body[1] = s.Container.Instance
+	if s.Range {
+		body[2] |= 0x80
+	}
+	if s.Linked {
+		body[2] |= 0x40
+	}
+	if s.PresenceSensorAlwaysAccessed {
+		body[2] |= 0x20
+	}
+	for i, e := range s.Entities {
+		body[3+2*i] = e.Id
+		body[4+2*i] = e.Instance
+	}
+	return s.marshal(SDR_TYPE_ENTITY_ASSOCIATION_RECORD, body)
+}
+
+// ContainedEntities returns the contained entities with ranges expanded
+// and unused (id 0) slots dropped
+func (s *SdrEntityAssociationRecord) ContainedEntities() []EntityRef {
+	var entities []EntityRef
+	if !s.Range {
+		for _, e := range s.Entities {
+			if e.Id != 0 {
+				entities = append(entities, e)
+			}
+		}
+		return entities
+	}
+	for i := 0; i < len(s.Entities); i += 2 {
+		first, last := s.Entities[i], s.Entities[i+1]
+		if first.Id == 0 {
+			continue
+		}
+		for inst := int(first.Instance); inst <= int(last.Instance); inst++ {
+			entities = append(entities, EntityRef{Id: first.Id, Instance: uint8(inst)})
+		}
+	}
+	return entities
+}
+
+// SdrFruDeviceLocatorRecord locates a FRU inventory device (SDR type 0x11)
+type SdrFruDeviceLocatorRecord struct {
+	SdrCommonHeader
+	nextId uint16
+	Data   []byte
+	// AccessAddress is the slave address of the controller giving access
+	// to the FRU
+	AccessAddress uint8
+	// FruDeviceId is the FRU device id of a logical FRU device or the
+	// slave address of a non-logical one
+	FruDeviceId        uint8
+	Logical            bool
+	AccessLun          uint8
+	PrivateBusId       uint8
+	Channel            uint8
+	DeviceType         uint8
+	DeviceTypeModifier uint8
+	EntityId           uint8
+	EntityInstance     uint8
+	Oem                uint8
+	Id                 string
+}
+
+func NewSdrFruDeviceLocatorRecord(data []byte, nextId uint16) (SdrCommon, error) {
+	header, err := CommonHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	s := &SdrFruDeviceLocatorRecord{SdrCommonHeader: header, Data: data, nextId: nextId}
+	return s, s.UnmarshalBinary(data)
+}
+
+func (s *SdrFruDeviceLocatorRecord) UnmarshalBinary(data []byte) error {
+	if len(data) < 16 {
+		return DataTooShort
+	}
+	s.AccessAddress = data[5] & 0xfe
+	s.FruDeviceId = data[6]
+	s.Logical = data[7]&0x80 != 0
+	s.AccessLun = (data[7] >> 3) & 0x3
+	s.PrivateBusId = data[7] & 0x7
+	s.Channel = data[8] >> 4
+	s.DeviceType = data[10]
+	s.DeviceTypeModifier = data[11]
+	s.EntityId = data[12]
+	s.EntityInstance = data[13]
+	s.Oem = data[14]
+	var err error
+	s.Id, err = deviceIdString(NewByteBuffer(data[15:]))
+	return err
+}
+
+func (s *SdrFruDeviceLocatorRecord) MarshalBinary() ([]byte, error) {
+	id, err := idStringBytes(s.Id)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, 10, 10+len(id))
+	body[0] = s.AccessAddress & 0xfe
+	body[1] = s.FruDeviceId
+	body[2] = (s.AccessLun&0x3)<<3 | s.PrivateBusId&0x7
+	if s.Logical {
+		body[2] |= 0x80
+	}
+	body[3] = s.Channel << 4
+	body[5] = s.DeviceType
+	body[6] = s.DeviceTypeModifier
+	body[7] = s.EntityId
+	body[8] = s.EntityInstance
+	body[9] = s.Oem
+	return s.marshal(SDR_TYPE_FRU_DEVICE_LOCATOR_RECORD, append(body, id...))
+}
+
+// SdrMcDeviceLocatorRecord locates a management controller on IPMB
+// (SDR type 0x12)
+type SdrMcDeviceLocatorRecord struct {
+	SdrCommonHeader
+	nextId         uint16
+	Data           []byte
+	SlaveAddress   uint8
+	Channel        uint8
+	PowerStateInit uint8
+	// Capabilities is the device support bit field of Get Device ID
+	Capabilities   uint8
+	EntityId       uint8
+	EntityInstance uint8
+	Oem            uint8
+	Id             string
+}
+
+func NewSdrMcDeviceLocatorRecord(data []byte, nextId uint16) (SdrCommon, error) {
+	header, err := CommonHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	s := &SdrMcDeviceLocatorRecord{SdrCommonHeader: header, Data: data, nextId: nextId}
+	return s, s.UnmarshalBinary(data)
+}
+
+func (s *SdrMcDeviceLocatorRecord) UnmarshalBinary(data []byte) error {
+	if len(data) < 16 {
+		return DataTooShort
+	}
+	s.SlaveAddress = data[5] & 0xfe
+	s.Channel = data[6] & 0x0f
+	s.PowerStateInit = data[7]
+	s.Capabilities = data[8]
+	s.EntityId = data[12]
+	s.EntityInstance = data[13]
+	s.Oem = data[14]
+	var err error
+	s.Id, err = deviceIdString(NewByteBuffer(data[15:]))
+	return err
+}
+
+// Owner addresses the controller, for its Device SDRs
+func (s *SdrMcDeviceLocatorRecord) Owner() SensorOwner {
+	return SensorOwner{OwnerId: s.SlaveAddress, OwnerChannel: s.Channel}
+}
+
+func (s *SdrMcDeviceLocatorRecord) MarshalBinary() ([]byte, error) {
+	id, err := idStringBytes(s.Id)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, 10, 10+len(id))
+	body[0] = s.SlaveAddress & 0xfe
+	body[1] = s.Channel & 0x0f
+	body[2] = s.PowerStateInit
+	body[3] = s.Capabilities
+	body[7] = s.EntityId
+	body[8] = s.EntityInstance
+	body[9] = s.Oem
+	return s.marshal(SDR_TYPE_MANAGEMENT_CONTROLLER_DEVICE_LOCATOR_RECORD, append(body, id...))
+}
+
+// SdrMcConfirmationRecord records the identity of a management controller
+// found on IPMB (SDR type 0x13)
+type SdrMcConfirmationRecord struct {
+	SdrCommonHeader
+	nextId         uint16
+	Data           []byte
+	SlaveAddress   uint8
+	DeviceId       uint8
+	Channel        uint8
+	DeviceRevision uint8
+	FwRev1         uint8
+	FwRev2         uint8
+	IpmiVersion    uint8
+	ManufacturerId [3]uint8
+	ProductId      [2]uint8
+	Guid           [16]uint8
+}
+
+func NewSdrMcConfirmationRecord(data []byte, nextId uint16) (SdrCommon, error) {
+	header, err := CommonHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	s := &SdrMcConfirmationRecord{SdrCommonHeader: header, Data: data, nextId: nextId}
+	return s, s.UnmarshalBinary(data)
+}
+
+func (s *SdrMcConfirmationRecord) UnmarshalBinary(data []byte) error {
+	if len(data) < 32 {
+		return DataTooShort
+	}
+	s.SlaveAddress = data[5] & 0xfe
+	s.DeviceId = data[6]
+	s.Channel = data[7] >> 4
+	s.DeviceRevision = data[7] & 0x0f
+	s.FwRev1 = data[8] & 0x7f
+	s.FwRev2 = data[9]
+	s.IpmiVersion = data[10]
+	copy(s.ManufacturerId[:], data[11:14])
+	copy(s.ProductId[:], data[14:16])
+	copy(s.Guid[:], data[16:32])
+	return nil
+}
+
+func (s *SdrMcConfirmationRecord) MarshalBinary() ([]byte, error) {
+	body := make([]byte, 27)
+	body[0] = s.SlaveAddress & 0xfe
+	body[1] = s.DeviceId
+	body[2] = s.Channel<<4 | s.DeviceRevision&0x0f
+	body[3] = s.FwRev1 & 0x7f
+	body[4] = s.FwRev2
+	body[5] = s.IpmiVersion
+	copy(body[6:9], s.ManufacturerId[:])
+	copy(body[9:11], s.ProductId[:])
+	copy(body[11:27], s.Guid[:])
+	return s.marshal(SDR_TYPE_MANAGEMENT_CONTROLLER_CONFIRMATION_RECORD, body)
+}
+
+// SdrBmcMessageChannelInfoRecord describes the BMC message channels of
+// IPMI 1.0 systems (SDR type 0x14)
+type SdrBmcMessageChannelInfoRecord struct {
+	SdrCommonHeader
+	nextId uint16
+	Data   []byte
+	// Channels holds the protocol/transmit info byte of channels 0-7
+	Channels                     [8]uint8
+	MessagingInterruptType       uint8
+	EventMessageBufInterruptType uint8
+}
+
+func NewSdrBmcMessageChannelInfoRecord(data []byte, nextId uint16) (SdrCommon, error) {
+	header, err := CommonHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	s := &SdrBmcMessageChannelInfoRecord{SdrCommonHeader: header, Data: data, nextId: nextId}
+	return s, s.UnmarshalBinary(data)
+}
+
+func (s *SdrBmcMessageChannelInfoRecord) UnmarshalBinary(data []byte) error {
+	if len(data) < 15 {
+		return DataTooShort
+	}
+	copy(s.Channels[:], data[5:13])
+	s.MessagingInterruptType = data[13]
+	s.EventMessageBufInterruptType = data[14]
+	return nil
+}
+
+func (s *SdrBmcMessageChannelInfoRecord) MarshalBinary() ([]byte, error) {
+	body := make([]byte, 11)
+	copy(body, s.Channels[:])
+	body[8] = s.MessagingInterruptType
+	body[9] = s.EventMessageBufInterruptType
+	return s.marshal(SDR_TYPE_BMC_MESSAGE_CHANNEL_INFO_RECORD, body)
+}
+
+// SdrOemRecord is a vendor specific record (SDR type 0xC0)
+type SdrOemRecord struct {
+	SdrCommonHeader
+	nextId         uint16
+	Data           []byte
+	ManufacturerId uint32
+	OemData        []byte
+}
+
+func NewSdrOemRecord(data []byte, nextId uint16) (SdrCommon, error) {
+	header, err := CommonHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	s := &SdrOemRecord{SdrCommonHeader: header, Data: data, nextId: nextId}
+	return s, s.UnmarshalBinary(data)
+}
+
+func (s *SdrOemRecord) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return DataTooShort
+	}
+	s.ManufacturerId = uint32(data[5]) | uint32(data[6])<<8 | uint32(data[7])<<16
+	s.OemData = data[8:]
+	return nil
+}
+
+func (s *SdrOemRecord) MarshalBinary() ([]byte, error) {
+	typ := s.typ
+	if typ < SDR_TYPE_OEM_SENSOR_RECORD {
+		typ = SDR_TYPE_OEM_SENSOR_RECORD
+	}
+	body := []byte{uint8(s.ManufacturerId), uint8(s.ManufacturerId >> 8), uint8(s.ManufacturerId >> 16)}
+	return s.marshal(typ, append(body, s.OemData...))
+}
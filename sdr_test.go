@@ -0,0 +1,256 @@
+package goipmi
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"math"
+	"testing"
+)
+
+var linearizationNames = map[uint8]string{
+	L_LINEAR: "linear", L_LN: "ln", L_LOG: "log10", L_LOG2: "log2",
+	L_E: "e", L_EXP10: "exp10", L_EXP2: "exp2", L_1_X: "1/x",
+	L_SQR: "sqr", L_CUBE: "cube", L_SQRT: "sqrt", L_CUBERT: "cubert",
+}
+
+var dataFormatNames = map[uint8]string{
+	DATA_FMT_UNSIGNED:      "unsigned",
+	DATA_FMT_1S_COMPLEMENT: "1's complement",
+	DATA_FMT_2S_COMPLEMENT: "2's complement",
+}
+
+// conversionSensor is a sensor converting raw to f((3*raw - 70) / 10)
+func conversionSensor(linearization, format uint8) *SdrFullSensorRecord {
+	return &SdrFullSensorRecord{
+		linearization:    linearization,
+		analogDataFormat: format,
+		m:                3,
+		b:                -7,
+		k1:               1,
+		k2:               -1,
+	}
+}
+
+func TestConvertSensorValueToRaw(t *testing.T) {
+	for l := uint8(L_LINEAR); l <= L_CUBERT; l++ {
+		for format := DATA_FMT_UNSIGNED; format <= DATA_FMT_2S_COMPLEMENT; format++ {
+			s := conversionSensor(l, format)
+			n := 0
+			for raw := 0; raw <= 0xff; raw++ {
+				value, err := s.ConvertSensorRawToValue(raw)
+				if err != nil {
+					t.Fatalf("%s %s: raw %#x: %v", linearizationNames[l], dataFormatNames[format], raw, err)
+				}
+				if math.IsNaN(value) || math.IsInf(value, 0) {
+					// outside the domain of the linearization
+					continue
+				}
+				n++
+				got, err := s.ConvertSensorValueToRaw(value)
+				if err != nil {
+					t.Errorf("%s %s: raw %#x value %v: %v", linearizationNames[l], dataFormatNames[format], raw, value, err)
+					continue
+				}
+				if int(got) == raw {
+					continue
+				}
+				// -0 in 1's complement and the negative root of sqr convert
+				// to the same value as another raw reading
+				if v, _ := s.ConvertSensorRawToValue(int(got)); v != value {
+					t.Errorf("%s %s: raw %#x value %v: got raw %#x value %v", linearizationNames[l], dataFormatNames[format], raw, value, got, v)
+				}
+			}
+			if n == 0 {
+				t.Errorf("%s %s: no raw reading in the domain", linearizationNames[l], dataFormatNames[format])
+			}
+		}
+	}
+}
+
+func TestConvertSensorValueToRawErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		linearization uint8
+		format        uint8
+		value         float64
+	}{
+		{"NaN", L_LINEAR, DATA_FMT_UNSIGNED, math.NaN()},
+		{"log of negative", L_E, DATA_FMT_UNSIGNED, -1},
+		{"log10 of negative", L_EXP10, DATA_FMT_2S_COMPLEMENT, -1},
+		{"log2 of negative", L_EXP2, DATA_FMT_1S_COMPLEMENT, -1},
+		{"sqrt of negative", L_SQR, DATA_FMT_UNSIGNED, -4},
+		{"1/x at 0", L_1_X, DATA_FMT_UNSIGNED, 0},
+		{"above unsigned", L_LINEAR, DATA_FMT_UNSIGNED, 100},
+		{"below unsigned", L_LINEAR, DATA_FMT_UNSIGNED, -8},
+		{"above 1's complement", L_LINEAR, DATA_FMT_1S_COMPLEMENT, 32},
+		{"below 1's complement", L_LINEAR, DATA_FMT_1S_COMPLEMENT, -46},
+		{"above 2's complement", L_LINEAR, DATA_FMT_2S_COMPLEMENT, 32},
+		{"below 2's complement", L_LINEAR, DATA_FMT_2S_COMPLEMENT, -46},
+		{"above cube", L_CUBE, DATA_FMT_UNSIGNED, 1e6},
+		{"unknown linearization", 0x0c, DATA_FMT_UNSIGNED, 1},
+		{"no analog reading", L_LINEAR, DATA_FMT_NONE, 1},
+	}
+	for _, test := range tests {
+		s := conversionSensor(test.linearization, test.format)
+		if raw, err := s.ConvertSensorValueToRaw(test.value); err == nil {
+			t.Errorf("%s: got raw %#x, want an error", test.name, raw)
+		}
+	}
+	s := conversionSensor(L_LINEAR, DATA_FMT_UNSIGNED)
+	s.m = 0
+	if _, err := s.ConvertSensorValueToRaw(1); err == nil {
+		t.Error("M 0: want an error")
+	}
+}
+
+var sdrRecordTests = []struct {
+	name   string
+	record []byte
+}{
+	{"full sensor", []byte{
+		0x01, 0x00, 0x51, 0x01, 0x33,
+		0x20, 0x00, 0x01,
+		0x03, 0x01, 0x7f, 0x68, 0x01, 0x01,
+		0x80, 0x0a, 0x80, 0x0a, 0x38, 0x38,
+		0x00, 0x01, 0x00,
+		0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x28, 0x50, 0x05, 0x7f, 0x00,
+		0x69, 0x5f, 0x55, 0x00, 0x00, 0x00,
+		0x02, 0x02, 0x00, 0x00, 0x00,
+		0xc8, 'C', 'P', 'U', ' ', 'T', 'e', 'm', 'p',
+	}},
+	{"compact sensor", []byte{
+		0x03, 0x00, 0x51, 0x02, 0x26,
+		0x20, 0x00, 0x30,
+		0x0a, 0x01, 0x67, 0x40, 0x08, 0x6f,
+		0x0f, 0x00, 0x0f, 0x00, 0x0f, 0x00,
+		0xc0, 0x00, 0x00,
+		0x01, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0xcb, 'P', 'S', 'U', '1', ' ', 'S', 't', 'a', 't', 'u', 's',
+	}},
+	{"event-only sensor", []byte{
+		0x09, 0x00, 0x51, 0x03, 0x12,
+		0x20, 0x00, 0x50,
+		0x07, 0x01, 0x12, 0x6f, 0x00, 0x00, 0x00, 0x00,
+		0xc6, 'S', 'y', 's', 'E', 'v', 't',
+	}},
+	{"entity association", []byte{
+		0x0a, 0x00, 0x51, 0x08, 0x0b,
+		0x17, 0x01, 0x80,
+		0x0a, 0x01, 0x0a, 0x02, 0x00, 0x00, 0x00, 0x00,
+	}},
+	{"FRU device locator", []byte{
+		0x0b, 0x00, 0x51, 0x11, 0x0f,
+		0x20, 0x00, 0x80, 0x00, 0x00, 0x10, 0x00, 0x07, 0x01, 0x00,
+		0xc4, 'F', 'R', 'U', '0',
+	}},
+	{"MC device locator", []byte{
+		0x04, 0x00, 0x51, 0x12, 0x0e,
+		0x20, 0x00, 0x00, 0xbf, 0x00, 0x00, 0x00,
+		0x06, 0x01, 0x00,
+		0xc3, 'B', 'M', 'C',
+	}},
+	{"MC confirmation", []byte{
+		0x0c, 0x00, 0x51, 0x13, 0x1b,
+		0x20, 0x20, 0x01, 0x01, 0x00, 0x51,
+		0x57, 0x01, 0x00, 0x34, 0x12,
+		0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77,
+		0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff,
+	}},
+	{"BMC message channel info", []byte{
+		0x0d, 0x00, 0x51, 0x14, 0x0b,
+		0x01, 0x84, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x60, 0x61, 0x00,
+	}},
+	{"OEM", []byte{
+		0x0e, 0x00, 0x51, 0xc0, 0x05,
+		0x57, 0x01, 0x00, 0xde, 0xad,
+	}},
+}
+
+func TestSdrRecordMarshalBinary(t *testing.T) {
+	for _, test := range sdrRecordTests {
+		record, err := SdrCommonFromData(test.record, 0xffff)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		m, ok := record.(encoding.BinaryMarshaler)
+		if !ok {
+			t.Errorf("%s: %T is not a BinaryMarshaler", test.name, record)
+			continue
+		}
+		data, err := m.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(data, test.record) {
+			t.Errorf("%s: got\n% x\nwant\n% x", test.name, data, test.record)
+		}
+	}
+}
+
+func TestSampleSdrMarshalBinary(t *testing.T) {
+	s := NewSampleSimulator()
+	for i, raw := range s.sdr {
+		record, err := SdrCommonFromData(raw, 0xffff)
+		if err != nil {
+			t.Errorf("record %d: %v", i, err)
+			continue
+		}
+		data, err := record.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			t.Errorf("record %d: %v", i, err)
+			continue
+		}
+		if !bytes.Equal(data, raw) {
+			t.Errorf("record %d: got\n% x\nwant\n% x", i, data, raw)
+		}
+	}
+}
+
+func TestUnitsString(t *testing.T) {
+	// units 1 holds the rate, the modifier operation and the percentage
+	// bit, units 2 the base and units 3 the modifier unit
+	tests := []struct {
+		units1, units2, units3 uint8
+		want                   string
+	}{
+		{0x00, 0x01, 0x00, "degrees C"},
+		{0x00, 0x04, 0x05, "Volts"},
+		{0x28, 0x06, 0x00, "Watts per hour"},
+		{0x10, 0x12, 0x00, "RPM per ms"},
+		{0x01, 0x04, 0x00, "% Volts"},
+		{0x04, 0x11, 0x16, "CFM * second"},
+		{0x02, 0x04, 0x05, "Volts/Amps"},
+		{0x33, 0x06, 0x18, "% Watts/hour per day"},
+		{0x38, 0x04, 0x00, "Volts"},
+		{0x00, 0xff, 0x00, "unknown"},
+	}
+	for _, tt := range tests {
+		if got := newUnits(tt.units1, tt.units2, tt.units3).String(); got != tt.want {
+			t.Errorf("units % x: got %q, want %q", []uint8{tt.units1, tt.units2, tt.units3}, got, tt.want)
+		}
+
+		// the units of the full CPU Temp and the compact PSU1 Status records,
+		// the analog data format shares units 1 with the rate
+		s := NewSampleSimulator()
+		s.sdr[0][20], s.sdr[0][21], s.sdr[0][22] = tt.units1, tt.units2, tt.units3
+		s.sdr[2][20], s.sdr[2][21], s.sdr[2][22] = 0xc0|tt.units1, tt.units2, tt.units3
+		readings, err := s.Sensors(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range readings {
+			if r.Name != "CPU Temp" && r.Name != "PSU1 Status" {
+				continue
+			}
+			if r.Units.String() != tt.want || r.Unit != tt.want {
+				t.Errorf("%s units % x: got %q, unit %q, want %q", r.Name, []uint8{tt.units1, tt.units2, tt.units3}, r.Units, r.Unit, tt.want)
+			}
+		}
+	}
+}
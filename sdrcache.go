@@ -0,0 +1,151 @@
+package goipmi
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// sdrRecord is a raw SDR record as read from the repository
+type sdrRecord struct {
+	NextId uint16
+	Data   []byte
+}
+
+// decodeSdrRecords decodes the raw records, skipping those of unsupported
+// types
+func decodeSdrRecords(raw []sdrRecord) ([]SdrCommon, error) {
+	records := make([]SdrCommon, 0, len(raw))
+	for _, r := range raw {
+		sdr, err := SdrCommonFromData(r.Data, r.NextId)
+		if IsUnsupportedSDRTypeErr(err) {
+			continue
+		}
+		if err != nil {
+			if len(r.Data) < 2 {
+				return nil, errors.Wrap(err, "SDR record")
+			}
+			return nil, errors.Wrapf(err, "SDR record 0x%04x", binary.LittleEndian.Uint16(r.Data))
+		}
+		records = append(records, sdr)
+	}
+	return records, nil
+}
+
+// sdrCacheKey identifies a state of the repository
+type sdrCacheKey struct {
+	RecordCount        uint16
+	MostRecentAddition uint32
+	MostRecentErase    uint32
+}
+
+// sdrCacheFile is the on-disk form of an SdrCache
+type sdrCacheFile struct {
+	sdrCacheKey
+	Records []sdrRecord
+}
+
+// SdrCache keeps the records of an SDR repository between walks. The
+// repository is read again only when Get SDR Repository Info reports
+// another record count, most recent addition or most recent erase time.
+type SdrCache struct {
+	// Path, when set, is the file the raw records are persisted to
+	Path string
+
+	mu      sync.Mutex
+	valid   bool
+	key     sdrCacheKey
+	raw     []sdrRecord
+	records []SdrCommon
+}
+
+// NewSdrCache returns a cache persisted to path, loading what an earlier
+// run stored there. An empty path keeps the cache in memory only.
+func NewSdrCache(path string) (*SdrCache, error) {
+	c := &SdrCache{Path: path}
+	if path == "" {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file sdrCacheFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, errors.Wrapf(err, "Invalid SDR cache %s", path)
+	}
+	records, err := decodeSdrRecords(file.Records)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid SDR cache %s", path)
+	}
+	c.key = file.sdrCacheKey
+	c.raw = file.Records
+	c.records = records
+	c.valid = true
+	return c, nil
+}
+
+// Invalidate makes the next walk read the repository again
+func (c *SdrCache) Invalidate() {
+	c.mu.Lock()
+	c.valid = false
+	c.mu.Unlock()
+}
+
+func (c *SdrCache) lookup(info *GetSdrRepositoryInfoRsp) ([]SdrCommon, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.valid || c.key != cacheKey(info) {
+		return nil, false
+	}
+	return c.records, true
+}
+
+func (c *SdrCache) store(info *GetSdrRepositoryInfoRsp, raw []sdrRecord, records []SdrCommon) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.key = cacheKey(info)
+	c.raw = raw
+	c.records = records
+	c.valid = true
+	if c.Path == "" {
+		return nil
+	}
+	data, err := json.Marshal(&sdrCacheFile{sdrCacheKey: c.key, Records: raw})
+	if err != nil {
+		return err
+	}
+	// write and rename so a concurrent reader never sees a partial file
+	tmp, err := ioutil.TempFile(filepath.Dir(c.Path), filepath.Base(c.Path))
+	if err != nil {
+		return errors.Wrap(err, "Failed to save SDR cache")
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.Path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "Failed to save SDR cache")
+	}
+	return nil
+}
+
+func cacheKey(info *GetSdrRepositoryInfoRsp) sdrCacheKey {
+	return sdrCacheKey{
+		RecordCount:        info.RecordCount,
+		MostRecentAddition: info.MostRecentAddition,
+		MostRecentErase:    info.MostRecentErase,
+	}
+}
@@ -0,0 +1,70 @@
+package goipmi
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+)
+
+// DumpSdr writes the raw SDRs in the format of ipmitool "sdr dump": every
+// record, header included, one after the other
+func (c *Client) DumpSdr(w io.Writer) error {
+	return c.DumpSdrContext(context.Background(), w)
+}
+
+// DumpSdrContext is DumpSdr, ctx bounds the whole read
+func (c *Client) DumpSdrContext(ctx context.Context, w io.Writer) error {
+	device, err := c.deviceSdrOwner(ctx)
+	if err != nil {
+		return err
+	}
+	raw, err := c.fetchSdrRecords(ctx, device)
+	if err != nil {
+		return err
+	}
+	for _, r := range raw {
+		if _, err := w.Write(r.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadSdr decodes an SDR dump written by DumpSdr or ipmitool "sdr dump",
+// records of unsupported types are skipped
+func LoadSdr(r io.Reader) ([]SdrCommon, error) {
+	raw, err := readSdrDump(r)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSdrRecords(raw)
+}
+
+// readSdrDump splits a dump into records, the next record id of each is
+// the id of the record following it in the dump
+func readSdrDump(r io.Reader) ([]sdrRecord, error) {
+	br := bufio.NewReader(r)
+	var records []sdrRecord
+	for {
+		header := make([]byte, sdrHeaderLength)
+		n, err := io.ReadFull(br, header)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Errorf("SDR dump: truncated header after %d records (%d bytes)", len(records), n)
+		}
+		data := make([]byte, sdrHeaderLength+int(header[4]))
+		copy(data, header)
+		if _, err := io.ReadFull(br, data[sdrHeaderLength:]); err != nil {
+			return nil, errors.Errorf("SDR dump: record 0x%04x truncated", binary.LittleEndian.Uint16(header))
+		}
+		if len(records) > 0 {
+			records[len(records)-1].NextId = binary.LittleEndian.Uint16(data)
+		}
+		records = append(records, sdrRecord{NextId: 0xffff, Data: data})
+	}
+	return records, nil
+}
@@ -1,5 +1,3 @@
-// +build linux
-
 package goipmi
 
 import (
@@ -654,6 +652,31 @@ func GetEventSensorType(sensorType, eventType uint8, oem uint32, filter func(e E
 	return nil
 }
 
+// DecodeSensorStates names the states asserted in the state bits of a
+// Get Sensor Reading response (bit n is offset n) of a discrete sensor
+func DecodeSensorStates(sensorType, readingType uint8, states uint16, oem uint32) []string {
+	var names []string
+	for offset := uint8(0); offset < 15; offset++ {
+		if states&(1<<offset) == 0 {
+			continue
+		}
+		evt := GetEventSensorType(sensorType, readingType, oem, func(evt EventSensorType) bool {
+			return evt.Offset == offset && evt.Data == 0xff
+		})
+		if evt == nil {
+			evt = GetEventSensorType(sensorType, readingType, oem, func(evt EventSensorType) bool {
+				return evt.Offset == offset
+			})
+		}
+		if evt != nil {
+			names = append(names, strings.TrimSpace(evt.Desc))
+		} else {
+			names = append(names, fmt.Sprintf("State %d", offset))
+		}
+	}
+	return names
+}
+
 func UnmarshalSelBinary(entry []byte) (SelEntry, error) {
 	var e SelEntry
 	if len(entry) != 16 {
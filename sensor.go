@@ -0,0 +1,442 @@
+package goipmi
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"math"
+)
+
+// ThresholdStatus classifies the reading of a threshold sensor
+type ThresholdStatus uint8
+
+const (
+	ThresholdNa ThresholdStatus = iota
+	ThresholdOk
+	ThresholdLowerNonCritical
+	ThresholdLowerCritical
+	ThresholdLowerNonRecoverable
+	ThresholdUpperNonCritical
+	ThresholdUpperCritical
+	ThresholdUpperNonRecoverable
+)
+
+// String returns the status as ipmitool prints it: ok, nc, cr, nr or na
+func (s ThresholdStatus) String() string {
+	switch s {
+	case ThresholdOk:
+		return "ok"
+	case ThresholdLowerNonCritical, ThresholdUpperNonCritical:
+		return "nc"
+	case ThresholdLowerCritical, ThresholdUpperCritical:
+		return "cr"
+	case ThresholdLowerNonRecoverable, ThresholdUpperNonRecoverable:
+		return "nr"
+	}
+	return "na"
+}
+
+// Threshold returns the name of the crossed threshold (lnc .. unr), empty
+// for ok and na
+func (s ThresholdStatus) Threshold() string {
+	if s < ThresholdLowerNonCritical {
+		return ""
+	}
+	return sensorThresholds[s-ThresholdLowerNonCritical]
+}
+
+// thresholdStatus picks the most severe crossed threshold out of the
+// threshold bits (bit 0 lnc .. bit 5 unr)
+func thresholdStatus(bits uint8) ThresholdStatus {
+	for _, bit := range []uint8{5, 2, 4, 1, 3, 0} {
+		if bits&(1<<bit) != 0 {
+			return ThresholdLowerNonCritical + ThresholdStatus(bit)
+		}
+	}
+	return ThresholdOk
+}
+
+// SensorReading is a sensor described by a full or compact SDR record
+// together with its current reading.
+type SensorReading struct {
+	Name           string
+	RecordId       uint16
+	Number         uint8
+	OwnerId        uint8
+	OwnerLun       uint8
+	OwnerChannel   uint8
+	EntityId       uint8
+	EntityInstance uint8
+	SensorTypeCode uint8
+	SensorType     string
+	// ReadingType is the event/reading type code, 0x01 for threshold sensors
+	ReadingType uint8
+	UnitCode    uint8
+	Units       Units
+	Unit        string
+
+	// Value is the reading in engineering units, nil for discrete sensors
+	// and when no reading is available
+	Value *float64
+	Raw   uint8
+	// StateBits are the state bits of the reading, bit n is offset n
+	StateBits uint16
+	// States names the asserted states of a discrete sensor
+	States []string
+	// Status is the threshold status of a threshold sensor, Thresholds are
+	// its readable SDR thresholds in engineering units
+	Status     ThresholdStatus
+	Thresholds map[string]float64
+
+	ScanningDisabled bool
+	Unavailable      bool
+	// Err is the error reading or converting this sensor
+	Err error
+
+	Record SdrCommon
+}
+
+func (r *SensorReading) discrete() bool {
+	return r.ReadingType != 0x01
+}
+
+func (r *SensorReading) owner() SensorOwner {
+	return SensorOwner{OwnerLun: r.OwnerLun, OwnerId: r.OwnerId, OwnerChannel: r.OwnerChannel}
+}
+
+func (s *SdrFullSensorRecord) owner() SensorOwner {
+	return SensorOwner{OwnerLun: s.ownerLun, OwnerId: s.ownerId, OwnerChannel: s.ownerChannel}
+}
+
+// Sensors walks the SDR repository and reads every sensor, ctx bounds the
+// whole walk
+func (c *Client) Sensors(ctx context.Context) ([]SensorReading, error) {
+	var readings []SensorReading
+	err := c.SensorEntries(ctx, func(r SensorReading) bool {
+		readings = append(readings, r)
+		return true
+	})
+	return readings, err
+}
+
+// SensorEntries walks the SDR repository and calls fun with every sensor
+// read, until fun returns false
+func (c *Client) SensorEntries(ctx context.Context, fun func(SensorReading) bool) error {
+	oem, err := c.GetOemContext(ctx)
+	if err != nil {
+		return err
+	}
+	stop := errors.New("stop")
+	err = c.walkSdrRepository(ctx, func(sdr SdrCommon) error {
+		sensors := []SdrCommon{sdr}
+		if compact, ok := sdr.(*SdrCompactSensorRecord); ok {
+			sensors = sensors[:0]
+			for _, shared := range compact.Shared() {
+				sensors = append(sensors, shared)
+			}
+		}
+		for _, sensor := range sensors {
+			r, ok := newSensorReading(sensor)
+			if !ok {
+				return nil
+			}
+			if err := c.readSensor(ctx, &r, oem); err != nil {
+				return err
+			}
+			if !fun(r) {
+				return stop
+			}
+		}
+		return nil
+	})
+	if err == stop {
+		return nil
+	}
+	return err
+}
+
+func newSensorReading(sdr SdrCommon) (SensorReading, bool) {
+	switch t := sdr.(type) {
+	case *SdrFullSensorRecord:
+		return SensorReading{
+			Name:           t.Id,
+			RecordId:       t.id,
+			Number:         t.number,
+			OwnerId:        t.ownerId,
+			OwnerLun:       t.ownerLun,
+			OwnerChannel:   t.ownerChannel,
+			EntityId:       t.entityId,
+			EntityInstance: t.entityInstance,
+			SensorTypeCode: t.sensorTypeCode,
+			SensorType:     t.SensorType(),
+			ReadingType:    t.eventReadingTypeCode,
+			UnitCode:       t.UnitCode(),
+			Units:          t.Units(),
+			Unit:           t.Unit(),
+			Record:         t,
+		}, true
+	case *SdrCompactSensorRecord:
+		return SensorReading{
+			Name:           t.Id,
+			RecordId:       t.id,
+			Number:         t.number,
+			OwnerId:        t.ownerId,
+			OwnerLun:       t.ownerLun,
+			OwnerChannel:   t.ownerChannel,
+			EntityId:       t.entityId,
+			EntityInstance: t.entityInstance,
+			SensorTypeCode: t.sensorTypeCode,
+			SensorType:     t.SensorType(),
+			ReadingType:    t.readingType,
+			UnitCode:       t.UnitCode(),
+			Units:          t.Units(),
+			Unit:           t.Unit(),
+			Record:         t,
+		}, true
+	}
+	return SensorReading{}, false
+}
+
+// readSensor issues Get Sensor Reading for r, errors of the sensor itself
+// are kept in r.Err, only a done ctx is returned
+func (c *Client) readSensor(ctx context.Context, r *SensorReading, oem uint32) error {
+	resp := &GetSensorReadingRsp{}
+	err := c.SendMessageContext(ctx, &GetSensorReadingReq{
+		SensorNumber: r.Number,
+		SensorOwner:  r.owner(),
+	}, resp)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		r.Err = err
+		return nil
+	}
+	r.Raw = resp.SensorReading
+	r.ScanningDisabled = resp.SensorScanningDisabled() == 0
+	r.Unavailable = resp.InitialUpdateInProgress() == 1
+	if resp.States1 != nil {
+		r.StateBits = uint16(*resp.States1)
+		if resp.States2 != nil {
+			r.StateBits |= uint16(*resp.States2&0x7f) << 8
+		}
+	}
+	if r.discrete() {
+		r.States = DecodeSensorStates(r.SensorTypeCode, r.ReadingType, r.StateBits, oem)
+	}
+	full, ok := r.Record.(*SdrFullSensorRecord)
+	if !ok || full.analogDataFormat == DATA_FMT_NONE || r.ScanningDisabled || r.Unavailable {
+		return nil
+	}
+	val, err := c.sensorValue(ctx, full, r.Raw)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		r.Err = err
+		return nil
+	}
+	r.Value = &val
+	if r.discrete() {
+		return nil
+	}
+	thresholds, err := full.thresholds(func(raw uint8) (float64, error) {
+		return c.sensorValue(ctx, full, raw)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		r.Err = err
+		return nil
+	}
+	r.evalThresholds(thresholds, resp.States1 != nil)
+	return nil
+}
+
+// sensorFactorsKey identifies the factors of one reading of a sensor
+type sensorFactorsKey struct {
+	ownerId, ownerChannel, ownerLun, number, reading uint8
+}
+
+// sensorValue converts a raw reading of s, the factors of non-linear
+// sensors are read from the BMC once per range of readings and cached
+func (c *Client) sensorValue(ctx context.Context, s *SdrFullSensorRecord, raw uint8) (float64, error) {
+	if !s.NonLinear() {
+		return s.ConvertSensorRawToValue(int(raw))
+	}
+	key := sensorFactorsKey{s.ownerId, s.ownerChannel, s.ownerLun, s.number, raw}
+	c.mu.Lock()
+	f, ok := c.factors[key]
+	c.mu.Unlock()
+	if !ok {
+		resp := &GetSensorReadingFactorsRsp{}
+		err := c.SendMessageContext(ctx, &GetSensorReadingFactorsReq{
+			SensorNumber: s.number,
+			Reading:      raw,
+			SensorOwner:  s.owner(),
+		}, resp)
+		if err != nil {
+			return 0, errors.Wrap(err, "Get Sensor Reading Factors")
+		}
+		f = resp.Factors
+		c.mu.Lock()
+		if c.factors == nil {
+			c.factors = map[sensorFactorsKey]SensorFactors{}
+		}
+		// the factors hold up to the next reading that has others, a next
+		// reading not above raw means up to the end of the range
+		end := int(resp.NextReading)
+		if end <= int(raw) {
+			end = 0x100
+		}
+		for next := int(raw); next < end; next++ {
+			key.reading = uint8(next)
+			c.factors[key] = f
+		}
+		c.mu.Unlock()
+	}
+	return s.ConvertSensorRawToValueWithFactors(int(raw), f), nil
+}
+
+// sensorRaw is the inverse of sensorValue. A non-linear sensor has no
+// closed form inverse, every raw reading is converted with the factors
+// of its range and the closest one is taken.
+func (c *Client) sensorRaw(ctx context.Context, s *SdrFullSensorRecord, value float64) (uint8, error) {
+	if !s.NonLinear() {
+		return s.ConvertSensorValueToRaw(value)
+	}
+	best, bestDiff := 0, math.Inf(1)
+	min, max := math.Inf(1), math.Inf(-1)
+	for raw := 0; raw <= 0xff; raw++ {
+		v, err := c.sensorValue(ctx, s, uint8(raw))
+		if err != nil {
+			return 0, err
+		}
+		min, max = math.Min(min, v), math.Max(max, v)
+		if d := math.Abs(v - value); d < bestDiff {
+			best, bestDiff = raw, d
+		}
+	}
+	if math.IsNaN(value) || value < min || value > max {
+		return 0, errors.Errorf("%v is out of the sensor range %v..%v", value, min, max)
+	}
+	return uint8(best), nil
+}
+
+// evalThresholds sets the threshold status from the comparison bits of the
+// reading or, when the BMC did not return them, from the SDR thresholds
+func (r *SensorReading) evalThresholds(thresholds map[string]float64, haveBits bool) {
+	r.Thresholds = thresholds
+	if haveBits {
+		r.Status = thresholdStatus(uint8(r.StateBits) & 0x3f)
+		return
+	}
+	var bits uint8
+	for i, name := range sensorThresholds {
+		limit, ok := thresholds[name]
+		if !ok {
+			continue
+		}
+		if (i < 3 && *r.Value <= limit) || (i >= 3 && *r.Value >= limit) {
+			bits |= 1 << uint(i)
+		}
+	}
+	r.Status = thresholdStatus(bits)
+}
+
+func sensorThresholdIndex(name string) int {
+	for i, n := range sensorThresholds {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// GetSensorThresholds reads the thresholds currently set in the sensor of
+// the record, converted to engineering units
+func (c *Client) GetSensorThresholds(ctx context.Context, s *SdrFullSensorRecord) (map[string]float64, error) {
+	if !s.hasCapability("threshold_readable") && !s.hasCapability("threshold_read_and_setable") {
+		return nil, errors.Errorf("sensor %s has no readable thresholds", s.Id)
+	}
+	resp := &GetSensorThresholdsRsp{}
+	err := c.SendMessageContext(ctx, &GetSensorThresholdsReq{
+		SensorNumber: s.number,
+		SensorOwner:  s.owner(),
+	}, resp)
+	if err != nil {
+		return nil, err
+	}
+	thresholds := map[string]float64{}
+	for i, name := range sensorThresholds {
+		if resp.Mask&(1<<uint(i)) == 0 {
+			continue
+		}
+		val, err := c.sensorValue(ctx, s, resp.Thresholds[i])
+		if err != nil {
+			return nil, err
+		}
+		thresholds[name] = val
+	}
+	return thresholds, nil
+}
+
+// SetSensorThresholds sets the given thresholds (lnc .. unr, engineering
+// units) of the sensor, each must be settable according to the record
+func (c *Client) SetSensorThresholds(ctx context.Context, s *SdrFullSensorRecord, thresholds map[string]float64) error {
+	settable := s.SettableThresholds()
+	req := &SetSensorThresholdsReq{
+		SensorNumber: s.number,
+		SensorOwner:  s.owner(),
+	}
+	for name, val := range thresholds {
+		i := sensorThresholdIndex(name)
+		if i < 0 {
+			return errors.Errorf("unknown threshold %q", name)
+		}
+		if settable&(1<<uint(i)) == 0 {
+			return errors.Errorf("threshold %s of sensor %s is not settable", name, s.Id)
+		}
+		raw, err := c.sensorRaw(ctx, s, val)
+		if err != nil {
+			return errors.Wrapf(err, "threshold %s", name)
+		}
+		req.Mask |= 1 << uint(i)
+		req.Thresholds[i] = raw
+	}
+	if req.Mask == 0 {
+		return nil
+	}
+	return c.SendMessageContext(ctx, req, &EmptyRsp{})
+}
+
+// GetSensorHysteresis reads the positive- and negative-going hysteresis of
+// the sensor in raw reading counts
+func (c *Client) GetSensorHysteresis(ctx context.Context, s *SdrFullSensorRecord) (uint8, uint8, error) {
+	if !s.hasCapability("hysteresis_readable") && !s.hasCapability("hysteresis_read_and_setable") {
+		return 0, 0, errors.Errorf("sensor %s has no readable hysteresis", s.Id)
+	}
+	resp := &GetSensorHysteresisRsp{}
+	err := c.SendMessageContext(ctx, &GetSensorHysteresisReq{
+		SensorNumber: s.number,
+		SensorOwner:  s.owner(),
+	}, resp)
+	if err != nil {
+		return 0, 0, err
+	}
+	return resp.PositiveGoing, resp.NegativeGoing, nil
+}
+
+// SetSensorHysteresis sets the positive- and negative-going hysteresis of
+// the sensor in raw reading counts
+func (c *Client) SetSensorHysteresis(ctx context.Context, s *SdrFullSensorRecord, positive, negative uint8) error {
+	if !s.hasCapability("hysteresis_read_and_setable") {
+		return errors.Errorf("hysteresis of sensor %s is not settable", s.Id)
+	}
+	return c.SendMessageContext(ctx, &SetSensorHysteresisReq{
+		SensorNumber:  s.number,
+		PositiveGoing: positive,
+		NegativeGoing: negative,
+		SensorOwner:   s.owner(),
+	}, &EmptyRsp{})
+}
@@ -0,0 +1,530 @@
+package goipmi
+
+import (
+	"context"
+	"encoding"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SimulatedSensor is the state answered to Get Sensor Reading and the
+// sensor threshold and hysteresis commands
+type SimulatedSensor struct {
+	Reading uint8
+	States  uint16
+	// Unavailable reports the reading as "initial update in progress"
+	Unavailable      bool
+	ScanningDisabled bool
+	// ThresholdMask selects the readable Thresholds, lnc .. unr
+	ThresholdMask uint8
+	Thresholds    [6]uint8
+	Hysteresis    [2]uint8
+	// Factors answers Get Sensor Reading Factors of a non-linear sensor,
+	// each range of readings starts at its key
+	Factors map[uint8]SensorFactors
+}
+
+// Simulator is an in-process Transport emulating a BMC. It answers from a
+// configurable set of SDR records, sensor readings and SEL entries so the
+// Client can run without /dev/ipmi0.
+type Simulator struct {
+	*Client
+	DeviceId DevidRsp
+	// MaxSdrRead, when set, makes Get SDR refuse longer reads
+	MaxSdrRead uint8
+
+	mu             sync.Mutex
+	sdr            [][]byte
+	sensors        map[uint8]*SimulatedSensor
+	sel            [][]byte
+	sdrAddition    uint32
+	sdrErase       uint32
+	selAddition    uint32
+	sdrReservation uint16
+	selReservation uint16
+	satellites     map[uint8]*Simulator
+	powerOn        bool
+	close          int32
+}
+
+func NewSimulator() *Simulator {
+	s := &Simulator{
+		DeviceId: DevidRsp{
+			DeviceId:          0x20,
+			DeviceRevision:    0x01,
+			FwRev1:            0x01,
+			FwRev2:            0x00,
+			IpmiVersion:       0x02,
+			AdtlDeviceSupport: 0xbf,
+		},
+		sensors: map[uint8]*SimulatedSensor{},
+		powerOn: true,
+	}
+	s.Client = NewClient(s)
+	return s
+}
+
+func (s *Simulator) Open() error {
+	atomic.StoreInt32(&s.close, 0)
+	return nil
+}
+
+func (s *Simulator) Close() error {
+	atomic.StoreInt32(&s.close, 1)
+	return nil
+}
+
+func (s *Simulator) IsClose() bool {
+	return atomic.LoadInt32(&s.close) == 1
+}
+
+// AddSdr appends a raw SDR record (header included) to the repository
+func (s *Simulator) AddSdr(record []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sdr = append(s.sdr, record)
+	s.sdrAddition = uint32(time.Now().Unix())
+	// a repository change cancels the reservation
+	s.sdrReservation++
+}
+
+// AddSdrRecord encodes record and appends it to the repository
+func (s *Simulator) AddSdrRecord(record encoding.BinaryMarshaler) error {
+	data, err := record.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	s.AddSdr(data)
+	return nil
+}
+
+// ClearSdr erases the SDR repository
+func (s *Simulator) ClearSdr() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sdr = nil
+	s.sdrErase = uint32(time.Now().Unix())
+	s.sdrReservation++
+}
+
+// AddSatellite makes sat answer the requests bridged to the controller at
+// slaveAddr on IPMB
+func (s *Simulator) AddSatellite(slaveAddr uint8, sat *Simulator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.satellites == nil {
+		s.satellites = map[uint8]*Simulator{}
+	}
+	s.satellites[slaveAddr] = sat
+}
+
+// SetSensor sets the state answered for sensor number
+func (s *Simulator) SetSensor(number uint8, sensor SimulatedSensor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sensors[number] = &sensor
+}
+
+// AddSel appends a 16 byte SEL record, the record ID is assigned by the simulator
+func (s *Simulator) AddSel(entry []byte) error {
+	if len(entry) != 16 {
+		return errors.Errorf("invalid SEL entry len:%d != 16", len(entry))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record := make([]byte, 16)
+	copy(record, entry)
+	binary.LittleEndian.PutUint16(record, uint16(len(s.sel)+1))
+	s.sel = append(s.sel, record)
+	s.selAddition = uint32(time.Now().Unix())
+	return nil
+}
+
+func (s *Simulator) SendMessageContext(ctx context.Context, req Message, resp encoding.BinaryUnmarshaler) error {
+	if s.IsClose() {
+		return errors.New("ipmi is close")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := req.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	target := s
+	if _, slaveAddr, ok := bridgeTarget(req); ok {
+		s.mu.Lock()
+		target = s.satellites[slaveAddr]
+		s.mu.Unlock()
+		if target == nil {
+			return ErrDestUnavail
+		}
+	}
+	target.mu.Lock()
+	rspData, cc := target.handle(req.NetFn(), req.CmdId(), data)
+	target.mu.Unlock()
+	if cc != CommandCompleted {
+		return cc
+	}
+	return resp.UnmarshalBinary(rspData)
+}
+
+func (s *Simulator) handle(netFn NetworkFunction, cmd Command, data []byte) ([]byte, CompletionCode) {
+	switch netFn {
+	case NetworkFunctionApp:
+		switch cmd {
+		case CommandGetDeviceID:
+			return s.getDeviceId(), CommandCompleted
+		}
+	case NetworkFunctionChassis:
+		switch cmd {
+		case CommandChassisStatus:
+			var state uint8
+			if s.powerOn {
+				state = 0x01
+			}
+			return []byte{state, 0x00, 0x00, 0x00}, CommandCompleted
+		case CommandChassisControl:
+			return s.chassisControl(data)
+		}
+	case NetworkFunctionSensorEvent:
+		switch cmd {
+		case CommandGetDeviceSDRInfo:
+			// LUN 0 has sensors, static population
+			count := uint8(len(s.sensors))
+			if len(data) > 0 && data[0]&0x01 != 0 {
+				count = uint8(len(s.sdr))
+			}
+			return []byte{count, 0x01}, CommandCompleted
+		case CommandReserveDeviceSDRRepo:
+			s.sdrReservation++
+			return []byte{uint8(s.sdrReservation), uint8(s.sdrReservation >> 8)}, CommandCompleted
+		case CommandGetDeviceSDR:
+			return s.getSdr(data)
+		case CommandGetSensorReading:
+			return s.getSensorReading(data)
+		case CommandGetSensorFactors:
+			return s.getSensorFactors(data)
+		case CommandGetSensorThresholds:
+			sensor, cc := s.sensor(data, 1)
+			if cc != CommandCompleted {
+				return nil, cc
+			}
+			return append([]byte{sensor.ThresholdMask}, sensor.Thresholds[:]...), CommandCompleted
+		case CommandSetSensorThresholds:
+			sensor, cc := s.sensor(data, 8)
+			if cc != CommandCompleted {
+				return nil, cc
+			}
+			for i := range sensor.Thresholds {
+				if data[1]&(1<<uint(i)) != 0 {
+					sensor.Thresholds[i] = data[2+i]
+				}
+			}
+			return nil, CommandCompleted
+		case CommandGetSensorHysteresis:
+			sensor, cc := s.sensor(data, 2)
+			if cc != CommandCompleted {
+				return nil, cc
+			}
+			return sensor.Hysteresis[:], CommandCompleted
+		case CommandSetSensorHysteresis:
+			sensor, cc := s.sensor(data, 4)
+			if cc != CommandCompleted {
+				return nil, cc
+			}
+			copy(sensor.Hysteresis[:], data[2:4])
+			return nil, CommandCompleted
+		}
+	case NetworkFunctionStorge:
+		if cmd == CommandGetSDRRepositoryInfo || cmd == CommandGetReserveSDRRepo || cmd == CommandGetSDR {
+			// a sensor device only answers Device SDR commands
+			if !s.DeviceId.SdrRepositoryDevice() {
+				return nil, ErrInvalidCommand
+			}
+		}
+		switch cmd {
+		case CommandGetSDRRepositoryInfo:
+			rsp := make([]byte, 14)
+			rsp[0] = 0x51
+			binary.LittleEndian.PutUint16(rsp[1:], uint16(len(s.sdr)))
+			binary.LittleEndian.PutUint16(rsp[3:], 0xffff)
+			binary.LittleEndian.PutUint32(rsp[5:], s.sdrAddition)
+			binary.LittleEndian.PutUint32(rsp[9:], s.sdrErase)
+			rsp[13] = 0x02
+			return rsp, CommandCompleted
+		case CommandGetReserveSDRRepo:
+			s.sdrReservation++
+			return []byte{uint8(s.sdrReservation), uint8(s.sdrReservation >> 8)}, CommandCompleted
+		case CommandGetSDR:
+			return s.getSdr(data)
+		case 0x40: // Get SEL Info
+			rsp := make([]byte, 14)
+			rsp[0] = 0x51
+			binary.LittleEndian.PutUint16(rsp[1:], uint16(len(s.sel)))
+			binary.LittleEndian.PutUint16(rsp[3:], 0xffff)
+			binary.LittleEndian.PutUint32(rsp[5:], s.selAddition)
+			rsp[13] = 0x02
+			return rsp, CommandCompleted
+		case 0x42: // Reserve SEL
+			s.selReservation++
+			return []byte{uint8(s.selReservation), uint8(s.selReservation >> 8)}, CommandCompleted
+		case 0x43: // Get SEL Entry
+			return s.getSelEntry(data)
+		}
+	}
+	return nil, ErrInvalidCommand
+}
+
+func (s *Simulator) getDeviceId() []byte {
+	d := s.DeviceId
+	rsp := []byte{d.DeviceId, d.DeviceRevision, d.FwRev1, d.FwRev2, d.IpmiVersion, d.AdtlDeviceSupport}
+	rsp = append(rsp, d.ManufacturerId[:]...)
+	rsp = append(rsp, d.ProductId[:]...)
+	return append(rsp, d.AuxFwRev[:]...)
+}
+
+func (s *Simulator) chassisControl(data []byte) ([]byte, CompletionCode) {
+	if len(data) < 1 {
+		return nil, ErrShortPacket
+	}
+	switch ChassisControl(data[0] & 0x0f) {
+	case ChassisPowerDown, ChassisSoftShutdown:
+		s.powerOn = false
+	case ChassisPowerUp, ChassisPowerCycle, ChassisHardReset:
+		s.powerOn = true
+	case ChassisPulseDiag:
+	default:
+		return nil, ErrInvalidPacket
+	}
+	return nil, CommandCompleted
+}
+
+// sensor returns the sensor addressed by the first byte of a request of
+// at least length bytes
+func (s *Simulator) sensor(data []byte, length int) (*SimulatedSensor, CompletionCode) {
+	if len(data) < length {
+		return nil, ErrShortPacket
+	}
+	sensor, ok := s.sensors[data[0]]
+	if !ok {
+		return nil, ErrNoObj
+	}
+	return sensor, CommandCompleted
+}
+
+func (s *Simulator) getSensorFactors(data []byte) ([]byte, CompletionCode) {
+	sensor, cc := s.sensor(data, 2)
+	if cc != CommandCompleted {
+		return nil, cc
+	}
+	reading := int(data[1])
+	start, next := -1, 0x100
+	for r := range sensor.Factors {
+		if int(r) <= reading && int(r) > start {
+			start = int(r)
+		}
+		if int(r) > reading && int(r) < next {
+			next = int(r)
+		}
+	}
+	if start < 0 {
+		return nil, ErrInvalidCommand
+	}
+	// a next reading of 0 ends the range at the last reading
+	return append([]byte{uint8(next)}, encodeSensorFactors(sensor.Factors[uint8(start)])...), CommandCompleted
+}
+
+func (s *Simulator) getSensorReading(data []byte) ([]byte, CompletionCode) {
+	sensor, cc := s.sensor(data, 1)
+	if cc != CommandCompleted {
+		return nil, cc
+	}
+	config := uint8(0x40)
+	if sensor.ScanningDisabled {
+		config = 0x00
+	}
+	if sensor.Unavailable {
+		config |= 0x20
+	}
+	return []byte{sensor.Reading, config, uint8(sensor.States), uint8(sensor.States >> 8)}, CommandCompleted
+}
+
+// sdrIndex returns the index of recordId, 0x0000 is the first record
+func (s *Simulator) sdrIndex(recordId uint16) int {
+	if recordId == 0x0000 && len(s.sdr) > 0 {
+		return 0
+	}
+	for i, record := range s.sdr {
+		if len(record) >= 2 && binary.LittleEndian.Uint16(record) == recordId {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *Simulator) getSdr(data []byte) ([]byte, CompletionCode) {
+	if len(data) < 6 {
+		return nil, ErrShortPacket
+	}
+	reservationId := binary.LittleEndian.Uint16(data)
+	recordId := binary.LittleEndian.Uint16(data[2:])
+	offset := int(data[4])
+	length := int(data[5])
+	if offset != 0 && reservationId != s.sdrReservation {
+		return nil, ErrInvalidResv
+	}
+	if s.MaxSdrRead != 0 && length != 0xff && length > int(s.MaxSdrRead) {
+		return nil, ErrRequestData
+	}
+	i := s.sdrIndex(recordId)
+	if i < 0 {
+		return nil, ErrNoObj
+	}
+	record := s.sdr[i]
+	if offset > len(record) {
+		return nil, ErrParamRange
+	}
+	if length == 0xff || offset+length > len(record) {
+		length = len(record) - offset
+	}
+	nextId := uint16(0xffff)
+	if i+1 < len(s.sdr) {
+		nextId = binary.LittleEndian.Uint16(s.sdr[i+1])
+	}
+	rsp := []byte{uint8(nextId), uint8(nextId >> 8)}
+	return append(rsp, record[offset:offset+length]...), CommandCompleted
+}
+
+func (s *Simulator) getSelEntry(data []byte) ([]byte, CompletionCode) {
+	if len(data) < 6 {
+		return nil, ErrShortPacket
+	}
+	recordId := binary.LittleEndian.Uint16(data[2:])
+	if len(s.sel) == 0 {
+		return nil, ErrNoObj
+	}
+	i := int(recordId) - 1
+	switch recordId {
+	case 0x0000:
+		i = 0
+	case 0xffff:
+		i = len(s.sel) - 1
+	}
+	if i < 0 || i >= len(s.sel) {
+		return nil, ErrNoObj
+	}
+	nextId := uint16(0xffff)
+	if i+1 < len(s.sel) {
+		nextId = uint16(i + 2)
+	}
+	rsp := []byte{uint8(nextId), uint8(nextId >> 8)}
+	return append(rsp, s.sel[i]...), CommandCompleted
+}
+
+// NewSampleSimulator returns a Simulator populated with a small example
+// platform: a temperature and a voltage sensor, a power supply presence
+// sensor and one SEL entry.
+func NewSampleSimulator() *Simulator {
+	s := NewSimulator()
+	s.DeviceId.ManufacturerId = [3]uint8{0x57, 0x01, 0x00}
+	// full sensor record, "CPU Temp" degrees C, M=1
+	s.AddSdr([]byte{
+		0x01, 0x00, 0x51, 0x01, 0x33,
+		0x20, 0x00, 0x01,
+		0x03, 0x01, 0x7f, 0x68, 0x01, 0x01,
+		0x80, 0x0a, 0x80, 0x0a, 0x38, 0x38,
+		0x00, 0x01, 0x00,
+		0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x28, 0x50, 0x05, 0x7f, 0x00,
+		0x69, 0x5f, 0x55, 0x00, 0x00, 0x00,
+		0x02, 0x02, 0x00, 0x00, 0x00,
+		0xc8, 'C', 'P', 'U', ' ', 'T', 'e', 'm', 'p',
+	})
+	s.SetSensor(0x01, SimulatedSensor{
+		Reading:       45,
+		ThresholdMask: 0x38,
+		Thresholds:    [6]uint8{0x00, 0x00, 0x00, 0x55, 0x5f, 0x69},
+		Hysteresis:    [2]uint8{0x02, 0x02},
+	})
+	// full sensor record, "12V" Volts, M=6 K2=-2
+	s.AddSdr([]byte{
+		0x02, 0x00, 0x51, 0x01, 0x2e,
+		0x20, 0x00, 0x02,
+		0x07, 0x01, 0x7f, 0x68, 0x02, 0x01,
+		0x80, 0x0a, 0x80, 0x0a, 0x3f, 0x3f,
+		0x00, 0x04, 0x00,
+		0x00, 0x06, 0x00, 0x00, 0x00, 0x00, 0xe0,
+		0x00, 0xc8, 0xd7, 0xb9, 0xff, 0x00,
+		0xe4, 0xdd, 0xd6, 0xac, 0xb3, 0xba,
+		0x02, 0x02, 0x00, 0x00, 0x00,
+		0xc3, '1', '2', 'V',
+	})
+	s.SetSensor(0x02, SimulatedSensor{
+		Reading:       200,
+		ThresholdMask: 0x3f,
+		Thresholds:    [6]uint8{0xba, 0xb3, 0xac, 0xd6, 0xdd, 0xe4},
+		Hysteresis:    [2]uint8{0x02, 0x02},
+	})
+	// compact sensor record, "PSU1 Status" power supply presence
+	s.AddSdr([]byte{
+		0x03, 0x00, 0x51, 0x02, 0x26,
+		0x20, 0x00, 0x30,
+		0x0a, 0x01, 0x67, 0x40, 0x08, 0x6f,
+		0x0f, 0x00, 0x0f, 0x00, 0x0f, 0x00,
+		0xc0, 0x00, 0x00,
+		0x01, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0xcb, 'P', 'S', 'U', '1', ' ', 'S', 't', 'a', 't', 'u', 's',
+	})
+	s.SetSensor(0x30, SimulatedSensor{States: 0x0001})
+	// management controller device locator, the BMC itself
+	s.AddSdr([]byte{
+		0x04, 0x00, 0x51, 0x12, 0x0e,
+		0x20, 0x00, 0x00, 0xbf, 0x00, 0x00, 0x00,
+		0x06, 0x01, 0x00,
+		0xc3, 'B', 'M', 'C',
+	})
+	// compact sensor record shared by "DIMM A1" .. "DIMM A4", sensors
+	// 0x40-0x43, memory presence
+	s.AddSdr([]byte{
+		0x05, 0x00, 0x51, 0x02, 0x21,
+		0x20, 0x00, 0x40,
+		0x20, 0x01, 0x67, 0x40, 0x0c, 0x6f,
+		0x40, 0x00, 0x40, 0x00, 0x40, 0x00,
+		0xc0, 0x00, 0x00,
+		0x04, 0x81, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0xc6, 'D', 'I', 'M', 'M', ' ', 'A',
+	})
+	for n := uint8(0x40); n <= 0x43; n++ {
+		s.SetSensor(n, SimulatedSensor{States: 0x0040})
+	}
+	// entity associations: the chassis holds the system board and the
+	// power supply, the board processor 1, processor 1 DIMMs 1-4
+	_ = s.AddSdrRecord(&SdrEntityAssociationRecord{
+		SdrCommonHeader: SdrCommonHeader{id: 0x06},
+		Container:       EntityRef{Id: EntitySystemChassis, Instance: 1},
+		Entities:        [4]EntityRef{{Id: EntitySystemBoard, Instance: 1}, {Id: EntityPowerSupply, Instance: 1}},
+	})
+	_ = s.AddSdrRecord(&SdrEntityAssociationRecord{
+		SdrCommonHeader: SdrCommonHeader{id: 0x07},
+		Container:       EntityRef{Id: EntitySystemBoard, Instance: 1},
+		Entities:        [4]EntityRef{{Id: EntityProcessor, Instance: 1}},
+	})
+	_ = s.AddSdrRecord(&SdrEntityAssociationRecord{
+		SdrCommonHeader: SdrCommonHeader{id: 0x08},
+		Container:       EntityRef{Id: EntityProcessor, Instance: 1},
+		Range:           true,
+		Entities:        [4]EntityRef{{Id: EntityMemoryDevice, Instance: 1}, {Id: EntityMemoryDevice, Instance: 4}},
+	})
+	// power supply failure detected, asserted
+	_ = s.AddSel([]byte{
+		0x00, 0x00, 0x02, 0x00, 0x5e, 0x56, 0x5f,
+		0x20, 0x00, 0x04, 0x08, 0x30, 0x6f, 0x01, 0xff, 0xff,
+	})
+	return s
+}
@@ -0,0 +1,738 @@
+package goipmi
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"fmt"
+	"github.com/pkg/errors"
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestSimulatorSdrRepositoryEntries(t *testing.T) {
+	want := []struct {
+		name  string
+		value float64
+		unit  string
+	}{
+		{"CPU Temp", 45, "degrees C"},
+		{"12V", 12, "Volts"},
+	}
+	s := NewSampleSimulator()
+	i := 0
+	err := s.SdrRepositoryEntries(func(name string, value *float64, unitCode uint8, unit string, sensorType uint8, entityInstance uint8, sensorTypeName string, err error) {
+		if i >= len(want) {
+			t.Errorf("unexpected sensor %s", name)
+			return
+		}
+		w := want[i]
+		i++
+		if err != nil || value == nil {
+			t.Errorf("%s: value %v, error %v", name, value, err)
+			return
+		}
+		if name != w.name || math.Abs(*value-w.value) > 1e-9 || unit != w.unit {
+			t.Errorf("got %s %v %s, want %s %v %s", name, *value, unit, w.name, w.value, w.unit)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != len(want) {
+		t.Errorf("got %d sensors, want %d", i, len(want))
+	}
+}
+
+func TestSimulatorSelEntries(t *testing.T) {
+	want := [][]byte{
+		{0x01, 0x00, 0x02, 0x00, 0x5e, 0x56, 0x5f, 0x20, 0x00, 0x04, 0x08, 0x30, 0x6f, 0x01, 0xff, 0xff},
+	}
+	s := NewSampleSimulator()
+	var got [][]byte
+	err := s.SelEntries(func(entry []byte) bool {
+		got = append(got, append([]byte(nil), entry...))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("entry %d: got % x, want % x", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSimulatorSensors(t *testing.T) {
+	s := NewSampleSimulator()
+	readings, err := s.Sensors(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"CPU Temp", "12V", "PSU1 Status", "DIMM A1", "DIMM A2", "DIMM A3", "DIMM A4"}
+	if len(readings) != len(names) {
+		t.Fatalf("got %d readings, want %d", len(readings), len(names))
+	}
+	for i, r := range readings {
+		if r.Name != names[i] {
+			t.Errorf("reading %d: got %s, want %s", i, r.Name, names[i])
+		}
+		if r.Err != nil {
+			t.Errorf("%s: %v", r.Name, r.Err)
+		}
+	}
+	cpu := readings[0]
+	if cpu.Value == nil || *cpu.Value != 45 {
+		t.Errorf("CPU Temp: got %v, want 45", cpu.Value)
+	}
+	if cpu.Status != ThresholdOk {
+		t.Errorf("CPU Temp: got status %v, want ok", cpu.Status)
+	}
+	if cpu.Thresholds["ucr"] != 95 || len(cpu.Thresholds) != 3 {
+		t.Errorf("CPU Temp: got thresholds %v", cpu.Thresholds)
+	}
+	psu := readings[2]
+	if psu.Value != nil || len(psu.States) != 1 || psu.States[0] != "Presence detected" {
+		t.Errorf("PSU1 Status: got value %v, states %v", psu.Value, psu.States)
+	}
+}
+
+func TestSimulatorSensorsConcurrent(t *testing.T) {
+	s := NewSampleSimulator()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Sensors(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSimulatorChassis(t *testing.T) {
+	s := NewSampleSimulator()
+	for _, test := range []struct {
+		control ChassisControl
+		powerOn bool
+	}{
+		{ChassisPowerDown, false},
+		{ChassisPowerUp, true},
+		{ChassisSoftShutdown, false},
+		{ChassisPowerCycle, true},
+	} {
+		if err := s.ChassisControl(test.control); err != nil {
+			t.Fatalf("control %d: %v", test.control, err)
+		}
+		status, err := s.GetChassisStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.PowerOn() != test.powerOn {
+			t.Errorf("control %d: got power on %v, want %v", test.control, status.PowerOn(), test.powerOn)
+		}
+	}
+}
+
+func TestSimulatorMaxSdrRead(t *testing.T) {
+	s := NewSampleSimulator()
+	s.MaxSdrRead = 8
+	records, err := s.SdrRepositoryRecords(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(s.sdr) {
+		t.Fatalf("got %d records, want %d", len(records), len(s.sdr))
+	}
+	for i, record := range records {
+		data, err := record.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, s.sdr[i]) {
+			t.Errorf("record %d: got\n% x\nwant\n% x", i, data, s.sdr[i])
+		}
+	}
+	if n := s.sdrReadLength(); n == 0 || n > int(s.MaxSdrRead) {
+		t.Errorf("got read length %d, want at most %d", n, s.MaxSdrRead)
+	}
+}
+
+// satelliteSensorRecord is the full sensor record of "Sat Temp", sensor
+// 0x01 of the controller at 0xb0
+func satelliteSensorRecord(recordId uint8) []byte {
+	return []byte{
+		recordId, 0x00, 0x51, 0x01, 0x33,
+		0xb0, 0x00, 0x01,
+		0x03, 0x02, 0x7f, 0x68, 0x01, 0x01,
+		0x80, 0x0a, 0x80, 0x0a, 0x38, 0x38,
+		0x00, 0x01, 0x00,
+		0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x28, 0x50, 0x05, 0x7f, 0x00,
+		0x69, 0x5f, 0x55, 0x00, 0x00, 0x00,
+		0x02, 0x02, 0x00, 0x00, 0x00,
+		0xc8, 'S', 'a', 't', ' ', 'T', 'e', 'm', 'p',
+	}
+}
+
+// newSatelliteSimulator returns the sample simulator with a satellite
+// controller at 0xb0 on IPMB. The BMC repository locates the satellite
+// and holds its sensor, which shares its number with the CPU Temp sensor
+// of the BMC.
+func newSatelliteSimulator() (*Simulator, *Simulator) {
+	sat := NewSimulator()
+	// a sensor device without an SDR repository
+	sat.DeviceId.AdtlDeviceSupport = 0x01
+	sat.AddSdr(satelliteSensorRecord(0x01))
+	sat.SetSensor(0x01, SimulatedSensor{Reading: 30})
+
+	s := NewSampleSimulator()
+	s.AddSatellite(0xb0, sat)
+	_ = s.AddSdrRecord(&SdrMcDeviceLocatorRecord{
+		SdrCommonHeader: SdrCommonHeader{id: 0x09},
+		SlaveAddress:    0xb0,
+		Capabilities:    0x01,
+		EntityId:        EntitySystemBoard,
+		EntityInstance:  2,
+		Id:              "Satellite",
+	})
+	s.AddSdr(satelliteSensorRecord(0x0a))
+	return s, sat
+}
+
+func TestSimulatorSatelliteSensor(t *testing.T) {
+	s, _ := newSatelliteSimulator()
+	readings, err := s.Sensors(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, r := range readings {
+		if r.Err != nil {
+			t.Errorf("%s: %v", r.Name, r.Err)
+		}
+		if r.Value != nil {
+			values[r.Name] = *r.Value
+		}
+	}
+	if values["CPU Temp"] != 45 || values["Sat Temp"] != 30 {
+		t.Errorf("got CPU Temp %v, Sat Temp %v, want 45 and 30", values["CPU Temp"], values["Sat Temp"])
+	}
+}
+
+func TestSimulatorSatelliteDeviceSdrs(t *testing.T) {
+	s, sat := newSatelliteSimulator()
+	records, err := s.SdrRepositoryRecords(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mc *SdrMcDeviceLocatorRecord
+	for _, record := range records {
+		if r, ok := record.(*SdrMcDeviceLocatorRecord); ok && r.SlaveAddress == 0xb0 {
+			mc = r
+		}
+	}
+	if mc == nil {
+		t.Fatal("no locator record for the satellite")
+	}
+	records, err = s.DeviceSdrRecords(context.Background(), mc.Owner())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(sat.sdr) {
+		t.Fatalf("got %d Device SDRs, want %d", len(records), len(sat.sdr))
+	}
+	if r, ok := records[0].(*SdrFullSensorRecord); !ok || r.Id != "Sat Temp" {
+		t.Errorf("got %#v, want the Sat Temp record", records[0])
+	}
+
+	if _, err := s.DeviceSdrRecords(context.Background(), SensorOwner{OwnerId: 0xb2}); errors.Cause(err) != ErrDestUnavail {
+		t.Errorf("absent controller: got %v, want %v", err, ErrDestUnavail)
+	}
+}
+
+func TestSimulatorLongSdr(t *testing.T) {
+	// an OEM record of 255 body bytes, 260 with the header
+	record := append([]byte{0x09, 0x00, 0x51, 0xc0, 0xff, 0x57, 0x01, 0x00}, bytes.Repeat([]byte{0xa5}, 252)...)
+
+	s := NewSampleSimulator()
+	s.AddSdr(record)
+	records, err := s.SdrRepositoryRecords(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oem, ok := records[len(records)-1].(*SdrOemRecord)
+	if !ok || !bytes.Equal(oem.Data, record) {
+		t.Errorf("got %#v, want the 260 byte OEM record", records[len(records)-1])
+	}
+
+	// read 12 bytes at a time the body passes the one byte offset of
+	// Get SDR at 257
+	s = NewSampleSimulator()
+	s.MaxSdrRead = 12
+	s.AddSdr(record)
+	if _, err := s.SdrRepositoryRecords(context.Background()); err == nil {
+		t.Error("chunked read of a 260 byte record: want an error")
+	}
+}
+
+// countingTransport counts the commands sent to the simulator and fails
+// those in fail with an invalid command completion code
+type countingTransport struct {
+	*Simulator
+	mu     sync.Mutex
+	counts map[[2]uint8]int
+	fail   map[[2]uint8]bool
+}
+
+func newCountingTransport(s *Simulator) *countingTransport {
+	return &countingTransport{Simulator: s, counts: map[[2]uint8]int{}, fail: map[[2]uint8]bool{}}
+}
+
+func (t *countingTransport) SendMessageContext(ctx context.Context, req Message, resp encoding.BinaryUnmarshaler) error {
+	key := [2]uint8{uint8(req.NetFn()), uint8(req.CmdId())}
+	t.mu.Lock()
+	t.counts[key]++
+	fail := t.fail[key]
+	t.mu.Unlock()
+	if fail {
+		return ErrInvalidCommand
+	}
+	return t.Simulator.SendMessageContext(ctx, req, resp)
+}
+
+func (t *countingTransport) count(netFn NetworkFunction, cmd Command) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.counts[[2]uint8{uint8(netFn), uint8(cmd)}]
+}
+
+func TestSimulatorSdrCache(t *testing.T) {
+	s := NewSampleSimulator()
+	tr := newCountingTransport(s)
+	c := NewClient(tr)
+	c.SdrCache, _ = NewSdrCache("")
+	getSdrs := func() int { return tr.count(NetworkFunctionStorge, CommandGetSDR) }
+
+	walk := func() int {
+		records, err := c.SdrRepositoryRecords(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(records)
+	}
+	if n := walk(); n != len(s.sdr) || getSdrs() == 0 {
+		t.Fatalf("first walk: got %d records after %d Get SDR, want %d", n, getSdrs(), len(s.sdr))
+	}
+	read := getSdrs()
+	if n := walk(); n != len(s.sdr) || getSdrs() != read {
+		t.Errorf("cache hit: got %d records after %d more Get SDR, want %d and none", n, getSdrs()-read, len(s.sdr))
+	}
+
+	// a record added between two walks changes the repository info
+	s.AddSdr(satelliteSensorRecord(0x0a))
+	if n := walk(); n != len(s.sdr) || getSdrs() == read {
+		t.Errorf("cache miss: got %d records after %d more Get SDR, want %d and a refetch", n, getSdrs()-read, len(s.sdr))
+	}
+
+	// a BMC failing Get SDR Repository Info is read uncached
+	tr.fail[[2]uint8{uint8(NetworkFunctionStorge), uint8(CommandGetSDRRepositoryInfo)}] = true
+	read = getSdrs()
+	if n := walk(); n != len(s.sdr) || getSdrs() == read {
+		t.Errorf("no repository info: got %d records after %d more Get SDR, want %d and a refetch", n, getSdrs()-read, len(s.sdr))
+	}
+}
+
+// nonLinearSensorRecord is the full sensor record of "Exh Temp", sensor
+// 0x30 of the BMC with its factors read per reading
+func nonLinearSensorRecord(recordId uint8) []byte {
+	record := satelliteSensorRecord(recordId)
+	record[5], record[7] = 0x20, 0x30
+	record[23] = 0x70
+	copy(record[len(record)-8:], "Exh Temp")
+	return record
+}
+
+func TestSimulatorNonLinearSensor(t *testing.T) {
+	s := NewSampleSimulator()
+	s.AddSdr(nonLinearSensorRecord(0x09))
+	setFactors := func(m int) {
+		s.SetSensor(0x30, SimulatedSensor{Reading: 100, Factors: map[uint8]SensorFactors{
+			0x00: {M: m},
+			0x80: {M: 10 * m},
+		}})
+	}
+	read := func() float64 {
+		readings, err := s.Sensors(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range readings {
+			if r.Name != "Exh Temp" {
+				continue
+			}
+			if r.Err != nil || r.Value == nil {
+				t.Fatalf("Exh Temp: value %v, error %v", r.Value, r.Err)
+			}
+			return *r.Value
+		}
+		t.Fatal("no Exh Temp reading")
+		return 0
+	}
+
+	setFactors(1)
+	if v := read(); v != 100 {
+		t.Errorf("got %v, want 100", v)
+	}
+	// every uncached walk reads the repository and the factors again
+	setFactors(3)
+	if v := read(); v != 300 {
+		t.Errorf("factors changed: got %v, want 300", v)
+	}
+
+	s.SdrCache, _ = NewSdrCache("")
+	if v := read(); v != 300 {
+		t.Errorf("cached: got %v, want 300", v)
+	}
+	setFactors(2)
+	s.SdrCache.Invalidate()
+	if v := read(); v != 200 {
+		t.Errorf("cache invalidated: got %v, want 200", v)
+	}
+}
+
+func TestSimulatorUndecodableSdr(t *testing.T) {
+	// a generic device locator, a type without a decoder
+	s := NewSampleSimulator()
+	s.AddSdr([]byte{0x09, 0x00, 0x51, 0x10, 0x03, 0x20, 0x00, 0x00})
+	records, err := s.SdrRepositoryRecords(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(s.sdr)-1 {
+		t.Errorf("got %d records, want %d", len(records), len(s.sdr)-1)
+	}
+	if _, err := s.Sensors(context.Background()); err != nil {
+		t.Errorf("unsupported record type: got %v, want it skipped", err)
+	}
+
+	// a full sensor record cut after its sensor type
+	truncated := satelliteSensorRecord(0x0a)[:13]
+	truncated[4] = uint8(len(truncated) - 5)
+	s.AddSdr(truncated)
+	if _, err := s.SdrRepositoryRecords(context.Background()); err == nil {
+		t.Error("records: got no error for the truncated sensor record")
+	}
+	if _, err := s.Sensors(context.Background()); err == nil {
+		t.Error("sensors: got no error for the truncated sensor record")
+	}
+}
+
+// readSensorNamed reads the sensors of s and returns the one named name
+func readSensorNamed(t *testing.T, s *Simulator, name string) SensorReading {
+	t.Helper()
+	readings, err := s.Sensors(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range readings {
+		if r.Name == name {
+			return r
+		}
+	}
+	t.Fatalf("no %s reading", name)
+	return SensorReading{}
+}
+
+func TestSimulatorThresholdStatus(t *testing.T) {
+	// the 12V thresholds are lnr 172, lcr 179, lnc 186, unc 214, ucr 221
+	// and unr 228 raw, the comparison bits are those of the BMC
+	tests := []struct {
+		name      string
+		reading   uint8
+		bits      uint16
+		status    string
+		threshold string
+	}{
+		{"ok", 200, 0x00, "ok", ""},
+		{"lnc", 186, 0x01, "nc", "lnc"},
+		{"lcr", 179, 0x03, "cr", "lcr"},
+		{"lnr", 172, 0x07, "nr", "lnr"},
+		{"unc", 214, 0x08, "nc", "unc"},
+		{"ucr", 221, 0x18, "cr", "ucr"},
+		{"unr", 228, 0x38, "nr", "unr"},
+		// back inside a threshold but within its hysteresis of 2 counts,
+		// the BMC still asserts it
+		{"unc hysteresis", 213, 0x08, "nc", "unc"},
+		{"lcr hysteresis", 180, 0x03, "cr", "lcr"},
+		// past the hysteresis the BMC deasserts it
+		{"unc deasserted", 211, 0x00, "ok", ""},
+		{"ucr deasserted", 218, 0x08, "nc", "unc"},
+	}
+	s := NewSampleSimulator()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.SetSensor(0x02, SimulatedSensor{
+				Reading:       tt.reading,
+				States:        tt.bits,
+				ThresholdMask: 0x3f,
+				Thresholds:    [6]uint8{0xba, 0xb3, 0xac, 0xd6, 0xdd, 0xe4},
+				Hysteresis:    [2]uint8{0x02, 0x02},
+			})
+			r := readSensorNamed(t, s, "12V")
+			if r.Err != nil {
+				t.Fatal(r.Err)
+			}
+			if r.Status.String() != tt.status || r.Status.Threshold() != tt.threshold {
+				t.Errorf("got %s %q, want %s %q", r.Status, r.Status.Threshold(), tt.status, tt.threshold)
+			}
+		})
+	}
+}
+
+func TestEvalThresholds(t *testing.T) {
+	// without comparison bits the reading is compared to the thresholds,
+	// reaching a threshold crosses it
+	thresholds := map[string]float64{"lnr": 1, "lcr": 2, "lnc": 3, "unc": 7, "ucr": 8, "unr": 9}
+	tests := []struct {
+		value  float64
+		status ThresholdStatus
+	}{
+		{5, ThresholdOk},
+		{3.01, ThresholdOk},
+		{3, ThresholdLowerNonCritical},
+		{2, ThresholdLowerCritical},
+		{1, ThresholdLowerNonRecoverable},
+		{0, ThresholdLowerNonRecoverable},
+		{6.99, ThresholdOk},
+		{7, ThresholdUpperNonCritical},
+		{8, ThresholdUpperCritical},
+		{9, ThresholdUpperNonRecoverable},
+		{10, ThresholdUpperNonRecoverable},
+	}
+	for _, tt := range tests {
+		value := tt.value
+		r := SensorReading{Value: &value}
+		r.evalThresholds(thresholds, false)
+		if r.Status != tt.status {
+			t.Errorf("%v: got %v %s, want %v %s", tt.value, r.Status, r.Status.Threshold(), tt.status, tt.status.Threshold())
+		}
+	}
+
+	// only the readable thresholds count
+	value := 0.0
+	r := SensorReading{Value: &value}
+	r.evalThresholds(map[string]float64{"lnc": 3}, false)
+	if r.Status != ThresholdLowerNonCritical {
+		t.Errorf("lnc only: got %v, want nc", r.Status)
+	}
+}
+
+func TestSimulatorSharedSensorNames(t *testing.T) {
+	// the sharing bytes of the DIMM A record: share count and ID string
+	// instance modifier type, then entity instance sharing and modifier
+	// offset
+	tests := []struct {
+		name      string
+		sharing   [2]uint8
+		ids       []string
+		instances []uint8
+	}{
+		{"numeric", [2]uint8{0x04, 0x81}, []string{"DIMM A1", "DIMM A2", "DIMM A3", "DIMM A4"}, []uint8{1, 2, 3, 4}},
+		{"same instance", [2]uint8{0x04, 0x01}, []string{"DIMM A1", "DIMM A2", "DIMM A3", "DIMM A4"}, []uint8{1, 1, 1, 1}},
+		{"numeric from 0", [2]uint8{0x03, 0x00}, []string{"DIMM A0", "DIMM A1", "DIMM A2"}, []uint8{1, 1, 1}},
+		{"numeric offset", [2]uint8{0x02, 0x8a}, []string{"DIMM A10", "DIMM A11"}, []uint8{1, 2}},
+		{"alpha", [2]uint8{0x13, 0x80}, []string{"DIMM AA", "DIMM AB", "DIMM AC"}, []uint8{1, 2, 3}},
+		{"alpha offset", [2]uint8{0x13, 0x19}, []string{"DIMM AZ", "DIMM AAA", "DIMM AAB"}, []uint8{1, 1, 1}},
+		{"not shared", [2]uint8{0x01, 0x81}, []string{"DIMM A"}, []uint8{1}},
+		{"share count 0", [2]uint8{0x00, 0x00}, []string{"DIMM A"}, []uint8{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSampleSimulator()
+			s.sdr[4][23], s.sdr[4][24] = tt.sharing[0], tt.sharing[1]
+			readings, err := s.Sensors(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			var instances []uint8
+			for _, r := range readings {
+				if r.RecordId != 0x05 {
+					continue
+				}
+				if want := 0x40 + uint8(len(ids)); r.Number != want {
+					t.Errorf("%s: got sensor 0x%02x, want 0x%02x", r.Name, r.Number, want)
+				}
+				ids = append(ids, r.Name)
+				instances = append(instances, r.EntityInstance)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.ids) || !bytes.Equal(instances, tt.instances) {
+				t.Errorf("got %q instances %v, want %q instances %v", ids, instances, tt.ids, tt.instances)
+			}
+		})
+	}
+}
+
+// sdrName returns the ID string of a sensor or locator record
+func sdrName(sdr SdrCommon) string {
+	switch r := sdr.(type) {
+	case *SdrFullSensorRecord:
+		return r.Id
+	case *SdrCompactSensorRecord:
+		return r.Id
+	case *SdrMcDeviceLocatorRecord:
+		return r.Id
+	}
+	return fmt.Sprintf("%T", sdr)
+}
+
+func TestSimulatorEntityTree(t *testing.T) {
+	chassis := EntityRef{Id: EntitySystemChassis, Instance: 1}
+	board := EntityRef{Id: EntitySystemBoard, Instance: 1}
+	psu := EntityRef{Id: EntityPowerSupply, Instance: 1}
+	cpu := EntityRef{Id: EntityProcessor, Instance: 1}
+	dimm := func(i uint8) EntityRef { return EntityRef{Id: EntityMemoryDevice, Instance: i} }
+	bmc := EntityRef{Id: 0x06, Instance: 1}
+	tests := []struct {
+		entity   EntityRef
+		parent   *EntityRef
+		children []EntityRef
+		records  []string
+	}{
+		{chassis, nil, []EntityRef{board, psu}, nil},
+		{board, &chassis, []EntityRef{cpu}, []string{"12V"}},
+		{psu, &chassis, nil, []string{"PSU1 Status"}},
+		{cpu, &board, []EntityRef{dimm(1), dimm(2), dimm(3), dimm(4)}, []string{"CPU Temp"}},
+		{dimm(1), &cpu, nil, []string{"DIMM A1"}},
+		{dimm(4), &cpu, nil, []string{"DIMM A4"}},
+		{bmc, nil, nil, []string{"BMC"}},
+	}
+
+	s := NewSampleSimulator()
+	// neither a second container of the power supply nor a loop through
+	// the chassis changes the tree
+	_ = s.AddSdrRecord(&SdrEntityAssociationRecord{
+		SdrCommonHeader: SdrCommonHeader{id: 0x09},
+		Container:       board,
+		Entities:        [4]EntityRef{psu},
+	})
+	_ = s.AddSdrRecord(&SdrEntityAssociationRecord{
+		SdrCommonHeader: SdrCommonHeader{id: 0x0a},
+		Container:       dimm(2),
+		Entities:        [4]EntityRef{chassis},
+	})
+	tree, err := s.EntityTree(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		n := tree.Node(tt.entity)
+		if n == nil {
+			t.Errorf("%s: no node", tt.entity)
+			continue
+		}
+		if (n.Parent == nil) != (tt.parent == nil) || (n.Parent != nil && n.Parent.Entity != *tt.parent) {
+			t.Errorf("%s: got parent %v, want %v", tt.entity, n.Parent, tt.parent)
+		}
+		var children []EntityRef
+		for _, child := range n.Children {
+			if child.Parent != n {
+				t.Errorf("%s: child %s has parent %v", tt.entity, child.Entity, child.Parent)
+			}
+			children = append(children, child.Entity)
+		}
+		if fmt.Sprint(children) != fmt.Sprint(tt.children) {
+			t.Errorf("%s: got children %v, want %v", tt.entity, children, tt.children)
+		}
+		var records []string
+		for _, r := range n.Records {
+			records = append(records, sdrName(r))
+		}
+		if fmt.Sprint(records) != fmt.Sprint(tt.records) {
+			t.Errorf("%s: got records %q, want %q", tt.entity, records, tt.records)
+		}
+	}
+
+	var roots []EntityRef
+	for _, n := range tree.Roots() {
+		roots = append(roots, n.Entity)
+	}
+	if fmt.Sprint(roots) != fmt.Sprint([]EntityRef{bmc, chassis}) {
+		t.Errorf("got roots %v, want %s and %s", roots, bmc, chassis)
+	}
+	if !tree.Contains(chassis, dimm(3)) || tree.Contains(dimm(2), chassis) || tree.Contains(board, psu) {
+		t.Error("Contains does not follow the parent links")
+	}
+}
+
+func TestSimulatorSdrDumpRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		sim  func() *Simulator
+	}{
+		{"sample", NewSampleSimulator},
+		{"empty", NewSimulator},
+		{"chunked", func() *Simulator {
+			s := NewSampleSimulator()
+			s.MaxSdrRead = 16
+			return s
+		}},
+		{"long record", func() *Simulator {
+			s := NewSampleSimulator()
+			s.AddSdr(append([]byte{0x09, 0x00, 0x51, 0xc0, 0xff, 0x57, 0x01, 0x00}, bytes.Repeat([]byte{0xa5}, 252)...))
+			return s
+		}},
+		{"unsupported type", func() *Simulator {
+			s := NewSampleSimulator()
+			s.AddSdr([]byte{0x09, 0x00, 0x51, 0x10, 0x03, 0x20, 0x00, 0x00})
+			return s
+		}},
+		{"device SDRs", func() *Simulator {
+			_, sat := newSatelliteSimulator()
+			return sat
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.sim()
+			var buf bytes.Buffer
+			if err := s.DumpSdr(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if want := bytes.Join(s.sdr, nil); !bytes.Equal(buf.Bytes(), want) {
+				t.Fatalf("dump: got\n% x\nwant\n% x", buf.Bytes(), want)
+			}
+			loaded, err := LoadSdr(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			records, err := s.SdrRepositoryRecords(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(loaded) != len(records) {
+				t.Fatalf("got %d records, want %d", len(loaded), len(records))
+			}
+			for i := range records {
+				got, _ := loaded[i].(encoding.BinaryMarshaler).MarshalBinary()
+				want, _ := records[i].(encoding.BinaryMarshaler).MarshalBinary()
+				if !bytes.Equal(got, want) {
+					t.Errorf("record %d: got\n% x\nwant\n% x", i, got, want)
+				}
+			}
+			if buf.Len() > 0 {
+				if _, err := LoadSdr(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err == nil {
+					t.Error("truncated dump: want an error")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package goipmi
+
+import (
+	"context"
+	"encoding"
+)
+
+// Transport delivers IPMI request messages to a BMC and decodes the
+// response data (without the completion code) into resp.
+// A non-zero completion code is returned as a CompletionCode error.
+// Each request is bounded by the transport's own timeout and by ctx.
+type Transport interface {
+	Open() error
+	Close() error
+	SendMessageContext(ctx context.Context, req Message, resp encoding.BinaryUnmarshaler) error
+}